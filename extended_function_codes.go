@@ -0,0 +1,441 @@
+package modbus
+
+// Function codes not handled by the original RequestHandler interface.
+const (
+	FC_READ_FILE_RECORD			uint8	= 0x14
+	FC_WRITE_FILE_RECORD			uint8	= 0x15
+	FC_MASK_WRITE_REGISTER			uint8	= 0x16
+	FC_READ_WRITE_MULTIPLE_REGISTERS	uint8	= 0x17
+	FC_READ_FIFO_QUEUE			uint8	= 0x18
+	FC_ENCAPSULATED_INTERFACE_TRANSPORT	uint8	= 0x2b
+)
+
+// MEI (Modbus Encapsulated Interface) type carried by FC_ENCAPSULATED_INTERFACE_TRANSPORT
+// requests. Read Device Identification (0x0e) is currently the only one supported.
+const (
+	MEI_TYPE_READ_DEVICE_IDENTIFICATION	uint8	= 0x0e
+)
+
+// Read Device Identification categories, as carried by the request payload.
+const (
+	DEVICE_ID_BASIC		uint8	= 0x01
+	DEVICE_ID_REGULAR	uint8	= 0x02
+	DEVICE_ID_EXTENDED	uint8	= 0x03
+	DEVICE_ID_SPECIFIC	uint8	= 0x04
+)
+
+// FileRecordRequest describes a single sub-request of a Read/Write File
+// Record (FC 0x14/0x15) request.
+type FileRecordRequest struct {
+	FileNumber	uint16
+	RecordNumber	uint16
+	// RecordLength is the number of registers requested, i.e. the sub-request's
+	// "Record Length" field: for FC 0x14 (read), the number of registers the
+	// handler must return in HandleReadFileRecord's data; for FC 0x15 (write),
+	// it is redundant with len(RecordData) and provided for convenience.
+	RecordLength	uint16
+	// RecordData holds the registers to write (FC 0x15 only); ignored for reads.
+	RecordData	[]uint16
+}
+
+// DeviceIdentificationObject is a single (id, value) pair returned as part of
+// a Read Device Identification (FC 0x2b/0x0e) response, e.g. object 0x00 is
+// VendorName, 0x01 is ProductCode, 0x02 is MajorMinorRevision, and so on per
+// the spec; objects 0x80 and above are vendor-specific.
+type DeviceIdentificationObject struct {
+	Id	uint8
+	Value	[]byte
+}
+
+// FileRecordHandler is an optional extension of RequestHandler: handlers which
+// implement it are able to serve FC 0x14 (Read File Record) and FC 0x15
+// (Write File Record) requests. If a handler does not implement this
+// interface, the server replies with Illegal Function to both.
+type FileRecordHandler interface {
+	// HandleReadFileRecord is called once per sub-request found in the
+	// incoming FC 0x14 PDU. It should return the requested records' data.
+	HandleReadFileRecord (unitId uint8, req FileRecordRequest) (data []uint16, err error)
+
+	// HandleWriteFileRecord is called once per sub-request found in the
+	// incoming FC 0x15 PDU, with RecordData populated with the values to
+	// write.
+	HandleWriteFileRecord (unitId uint8, req FileRecordRequest) (err error)
+}
+
+// FIFOQueueHandler is an optional extension of RequestHandler: handlers which
+// implement it are able to serve FC 0x18 (Read FIFO Queue) requests. If a
+// handler does not implement this interface, the server replies with Illegal
+// Function.
+type FIFOQueueHandler interface {
+	// HandleReadFIFOQueue returns the current contents of the FIFO queue at
+	// addr, most recent read first. Per the spec, a single response can
+	// carry at most 31 registers; if more are returned, only the first 31
+	// are sent back to the client.
+	HandleReadFIFOQueue (unitId uint8, addr uint16) (fifo []uint16, err error)
+}
+
+// DeviceIdentificationHandler is an optional extension of RequestHandler:
+// handlers which implement it are able to serve FC 0x2b/0x0e (Read Device
+// Identification) requests. If a handler does not implement this interface,
+// the server replies with Illegal Function.
+type DeviceIdentificationHandler interface {
+	// HandleReadDeviceIdentification returns the object with id objectId (the
+	// first object to report, for a Basic/Regular/Extended stream request) as
+	// well as every subsequent object belonging to category up to the PDU size
+	// limit; the server sets the "more follows" continuation byte and trims
+	// the object list for the caller so handlers don't need to reimplement
+	// that bookkeeping, so implementations may simply return every object
+	// belonging to category starting at objectId.
+	HandleReadDeviceIdentification (unitId uint8, category uint8, objectId uint8) (
+					 objects []DeviceIdentificationObject, err error)
+}
+
+// illegalFunctionResponse builds the standard Illegal Function exception
+// response for req.
+func illegalFunctionResponse(req *pdu) *pdu {
+	return &pdu{
+		unitId:		req.unitId,
+		functionCode:	(0x80 | req.functionCode),
+		payload:	[]byte{EX_ILLEGAL_FUNCTION},
+	}
+}
+
+// handleMaskWriteRegister implements FC 0x16 on top of the existing
+// HandleHoldingRegisters callback: it reads the current register value, applies
+// the AND/OR masks, and writes the result back, all without requiring handlers
+// to implement any new interface.
+func (ms *ModbusServer) handleMaskWriteRegister(req *pdu, hc *HandlerContext) (res *pdu, err error) {
+	var addr	uint16
+	var andMask	uint16
+	var orMask	uint16
+	var current	[]uint16
+	var newValue	uint16
+
+	if len(req.payload) != 6 {
+		err = ErrProtocolError
+		return
+	}
+
+	addr		= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
+	andMask		= bytesToUint16(BIG_ENDIAN, req.payload[2:4])
+	orMask		= bytesToUint16(BIG_ENDIAN, req.payload[4:6])
+
+	current, err	= ms.callHandleHoldingRegisters(hc, req.unitId, addr, 1, false, nil)
+	if err != nil {
+		return
+	}
+	if len(current) != 1 {
+		err = ErrServerDeviceFailure
+		return
+	}
+
+	newValue	= (current[0] & andMask) | (orMask & ^andMask)
+
+	_, err	= ms.callHandleHoldingRegisters(hc, req.unitId, addr, 1, true, []uint16{newValue})
+	if err != nil {
+		return
+	}
+
+	res = &pdu{
+		unitId:		req.unitId,
+		functionCode:	req.functionCode,
+	}
+	res.payload	= append(res.payload, uint16ToBytes(BIG_ENDIAN, addr)...)
+	res.payload	= append(res.payload, uint16ToBytes(BIG_ENDIAN, andMask)...)
+	res.payload	= append(res.payload, uint16ToBytes(BIG_ENDIAN, orMask)...)
+
+	return
+}
+
+// handleReadWriteMultipleRegisters implements FC 0x17 on top of the existing
+// HandleHoldingRegisters callback, performing the write half of the request
+// before the read half as mandated by the spec.
+func (ms *ModbusServer) handleReadWriteMultipleRegisters(req *pdu, hc *HandlerContext) (res *pdu, err error) {
+	var readAddr, readQty		uint16
+	var writeAddr, writeQty	uint16
+	var byteCount			uint8
+	var regs			[]uint16
+
+	if len(req.payload) < 9 {
+		err = ErrProtocolError
+		return
+	}
+
+	readAddr	= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
+	readQty		= bytesToUint16(BIG_ENDIAN, req.payload[2:4])
+	writeAddr	= bytesToUint16(BIG_ENDIAN, req.payload[4:6])
+	writeQty	= bytesToUint16(BIG_ENDIAN, req.payload[6:8])
+	byteCount	= req.payload[8]
+
+	if readQty == 0 || readQty > 0x7d || writeQty == 0 || writeQty > 0x79 {
+		err = ErrProtocolError
+		return
+	}
+	if int(byteCount) != int(writeQty)*2 || len(req.payload)-9 != int(byteCount) {
+		err = ErrProtocolError
+		return
+	}
+
+	// perform the write first, then the read, as required by the spec
+	_, err = ms.callHandleHoldingRegisters(hc, req.unitId, writeAddr, writeQty,
+						 true, bytesToUint16s(BIG_ENDIAN, req.payload[9:]))
+	if err != nil {
+		return
+	}
+
+	regs, err = ms.callHandleHoldingRegisters(hc, req.unitId, readAddr, readQty, false, nil)
+	if err != nil {
+		return
+	}
+	if len(regs) != int(readQty) {
+		err = ErrServerDeviceFailure
+		return
+	}
+
+	res = &pdu{
+		unitId:		req.unitId,
+		functionCode:	req.functionCode,
+		payload:	[]byte{uint8(len(regs) * 2)},
+	}
+	res.payload	= append(res.payload, uint16sToBytes(BIG_ENDIAN, regs)...)
+
+	return
+}
+
+// handleReadFIFOQueue implements FC 0x18, bounding the response to the 31
+// registers allowed by the spec.
+func (ms *ModbusServer) handleReadFIFOQueue(req *pdu, hc *HandlerContext) (res *pdu, err error) {
+	var addr	uint16
+	var fifo	[]uint16
+	var fh		FIFOQueueHandler
+	var ok		bool
+
+	if fh, ok = ms.handler.(FIFOQueueHandler); !ok {
+		res = illegalFunctionResponse(req)
+		return
+	}
+
+	if len(req.payload) != 2 {
+		err = ErrProtocolError
+		return
+	}
+	addr	= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
+
+	fifo, err = fh.HandleReadFIFOQueue(req.unitId, addr)
+	if err != nil {
+		return
+	}
+	if len(fifo) > 31 {
+		fifo = fifo[:31]
+	}
+
+	res = &pdu{
+		unitId:		req.unitId,
+		functionCode:	req.functionCode,
+	}
+	// byte count, FIFO count, then the FIFO register values
+	res.payload	= append(res.payload, uint16ToBytes(BIG_ENDIAN, uint16(2+2*len(fifo)))...)
+	res.payload	= append(res.payload, uint16ToBytes(BIG_ENDIAN, uint16(len(fifo)))...)
+	res.payload	= append(res.payload, uint16sToBytes(BIG_ENDIAN, fifo)...)
+
+	return
+}
+
+// handleFileRecord implements FC 0x14 (read) and FC 0x15 (write), dispatching
+// each sub-request found in the PDU to the handler in turn.
+func (ms *ModbusServer) handleFileRecord(req *pdu, hc *HandlerContext) (res *pdu, err error) {
+	var fh		FileRecordHandler
+	var ok		bool
+	var reqLen	int
+	var resBody	[]byte
+
+	if fh, ok = ms.handler.(FileRecordHandler); !ok {
+		res = illegalFunctionResponse(req)
+		return
+	}
+
+	if len(req.payload) < 1 {
+		err = ErrProtocolError
+		return
+	}
+	reqLen	= int(req.payload[0])
+	if len(req.payload)-1 != reqLen {
+		err = ErrProtocolError
+		return
+	}
+
+	offset := 1
+	for offset < len(req.payload) {
+		var refType		uint8
+		var subReq		FileRecordRequest
+		var recordLen		uint16
+
+		if len(req.payload)-offset < 7 {
+			err = ErrProtocolError
+			return
+		}
+
+		refType			= req.payload[offset]
+		subReq.FileNumber	= bytesToUint16(BIG_ENDIAN, req.payload[offset+1:offset+3])
+		subReq.RecordNumber	= bytesToUint16(BIG_ENDIAN, req.payload[offset+3:offset+5])
+		recordLen		= bytesToUint16(BIG_ENDIAN, req.payload[offset+5:offset+7])
+		subReq.RecordLength	= recordLen
+		offset			+= 7
+
+		if refType != 0x06 {
+			err = ErrProtocolError
+			return
+		}
+
+		if req.functionCode == FC_WRITE_FILE_RECORD {
+			var byteLen	int
+
+			byteLen	= int(recordLen) * 2
+			if len(req.payload)-offset < byteLen {
+				err = ErrProtocolError
+				return
+			}
+			subReq.RecordData	= bytesToUint16s(BIG_ENDIAN, req.payload[offset:offset+byteLen])
+			offset			+= byteLen
+
+			if err = fh.HandleWriteFileRecord(req.unitId, subReq); err != nil {
+				return
+			}
+
+			resBody	= append(resBody, req.payload[offset-7-byteLen:offset]...)
+		} else {
+			var data	[]uint16
+
+			data, err = fh.HandleReadFileRecord(req.unitId, subReq)
+			if err != nil {
+				return
+			}
+			if len(data) != int(recordLen) {
+				ms.logger.Errorf("handler returned %v registers, " +
+						 "expected %v", len(data), recordLen)
+				err = ErrServerDeviceFailure
+				return
+			}
+
+			subResp	:= []byte{uint8(len(data)*2 + 1), 0x06}
+			subResp	= append(subResp, uint16sToBytes(BIG_ENDIAN, data)...)
+			resBody	= append(resBody, subResp...)
+		}
+	}
+
+	if req.functionCode == FC_READ_FILE_RECORD && len(resBody) > 255 {
+		// the byte count field preceding resBody is a single byte: a
+		// response this large would silently wrap around and corrupt the
+		// PDU, so fail the request instead
+		ms.logger.Errorf("file record read response too large to encode (%v bytes)",
+				 len(resBody))
+		err = ErrServerDeviceFailure
+		return
+	}
+
+	res = &pdu{
+		unitId:		req.unitId,
+		functionCode:	req.functionCode,
+	}
+	if req.functionCode == FC_READ_FILE_RECORD {
+		res.payload	= append([]byte{uint8(len(resBody))}, resBody...)
+	} else {
+		res.payload	= resBody
+	}
+
+	return
+}
+
+// handleEncapsulatedInterfaceTransport implements FC 0x2b, currently limited
+// to MEI type 0x0e (Read Device Identification), streaming Basic/Regular/
+// Extended objects with the "more follows" continuation byte set whenever the
+// handler has more objects than fit in a single PDU.
+func (ms *ModbusServer) handleEncapsulatedInterfaceTransport(req *pdu, hc *HandlerContext) (res *pdu, err error) {
+	var dh			DeviceIdentificationHandler
+	var ok			bool
+	var meiType		uint8
+	var category		uint8
+	var objectId		uint8
+	var objects		[]DeviceIdentificationObject
+	var body		[]byte
+	var objectCount		uint8
+	var moreFollows		uint8
+	var nextObjectId	uint8
+
+	if len(req.payload) != 3 {
+		err = ErrProtocolError
+		return
+	}
+
+	meiType		= req.payload[0]
+	category	= req.payload[1]
+	objectId	= req.payload[2]
+
+	if meiType != MEI_TYPE_READ_DEVICE_IDENTIFICATION {
+		res = illegalFunctionResponse(req)
+		return
+	}
+
+	if dh, ok = ms.handler.(DeviceIdentificationHandler); !ok {
+		res = illegalFunctionResponse(req)
+		return
+	}
+
+	objects, err = dh.HandleReadDeviceIdentification(req.unitId, category, objectId)
+	if err != nil {
+		return
+	}
+
+	// pack as many objects as fit in a single PDU (conservatively capped
+	// at 240 bytes of payload), signalling continuation otherwise
+	const maxBodyLen = 240
+	for _, obj := range objects {
+		var encoded	[]byte
+
+		encoded	= append(encoded, obj.Id, uint8(len(obj.Value)))
+		encoded	= append(encoded, obj.Value...)
+
+		if len(body)+len(encoded) > maxBodyLen {
+			moreFollows	= 0xff
+			nextObjectId	= obj.Id
+			break
+		}
+
+		body		= append(body, encoded...)
+		objectCount++
+	}
+
+	res = &pdu{
+		unitId:		req.unitId,
+		functionCode:	req.functionCode,
+	}
+	res.payload	= []byte{
+		meiType,
+		category,			// Read Device ID code: echoes the category requested
+		deviceIdConformityLevel(category),
+		moreFollows,
+		nextObjectId,
+		objectCount,
+	}
+	res.payload	= append(res.payload, body...)
+
+	return
+}
+
+// deviceIdConformityLevel returns the "Conformity level" byte reported in a
+// Read Device Identification response for the given requested category. This
+// server only ever serves objects via the streaming access defined by the
+// spec (no support for reading a single object by id outside of a stream),
+// so the conformity level simply mirrors the requested category: 0x01
+// (basic), 0x02 (regular) or 0x03 (extended, also reported for requests of
+// category 0x04).
+func deviceIdConformityLevel(category uint8) uint8 {
+	switch category {
+	case DEVICE_ID_REGULAR:
+		return 0x02
+	case DEVICE_ID_EXTENDED, DEVICE_ID_SPECIFIC:
+		return 0x03
+	default:
+		return 0x01
+	}
+}
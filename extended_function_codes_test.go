@@ -0,0 +1,308 @@
+package modbus
+
+import (
+	"testing"
+)
+
+// extendedTestHandler combines a memoryHandler with implementations of
+// FileRecordHandler, FIFOQueueHandler and DeviceIdentificationHandler so a
+// single handler can exercise every extended function code.
+type extendedTestHandler struct {
+	*memoryHandler
+
+	fileRecords	map[uint16]map[uint16][]uint16	// fileNumber -> recordNumber -> registers
+	fifo		[]uint16
+	deviceObjects	[]DeviceIdentificationObject
+}
+
+func newExtendedTestHandler() *extendedTestHandler {
+	return &extendedTestHandler{
+		memoryHandler: newMemoryHandler(),
+		fileRecords:   make(map[uint16]map[uint16][]uint16),
+	}
+}
+
+func (eh *extendedTestHandler) HandleReadFileRecord(unitId uint8, req FileRecordRequest) (data []uint16, err error) {
+	records, found := eh.fileRecords[req.FileNumber]
+	if !found {
+		err = ErrIllegalDataAddress
+		return
+	}
+	data, found = records[req.RecordNumber]
+	if !found {
+		err = ErrIllegalDataAddress
+		return
+	}
+	if uint16(len(data)) != req.RecordLength {
+		err = ErrIllegalDataAddress
+	}
+	return
+}
+
+func (eh *extendedTestHandler) HandleWriteFileRecord(unitId uint8, req FileRecordRequest) (err error) {
+	if eh.fileRecords[req.FileNumber] == nil {
+		eh.fileRecords[req.FileNumber] = make(map[uint16][]uint16)
+	}
+	eh.fileRecords[req.FileNumber][req.RecordNumber] = req.RecordData
+	return
+}
+
+func (eh *extendedTestHandler) HandleReadFIFOQueue(unitId uint8, addr uint16) (fifo []uint16, err error) {
+	fifo = eh.fifo
+	return
+}
+
+func (eh *extendedTestHandler) HandleReadDeviceIdentification(unitId uint8, category uint8,
+	objectId uint8) (objects []DeviceIdentificationObject, err error) {
+	for _, obj := range eh.deviceObjects {
+		if obj.Id >= objectId {
+			objects = append(objects, obj)
+		}
+	}
+	return
+}
+
+// newDispatchTestServer returns a *ModbusServer wired up with handler, without
+// binding any socket, so dispatchRequest can be exercised directly at the
+// byte level.
+func newDispatchTestServer(t *testing.T, handler RequestHandler) *ModbusServer {
+	t.Helper()
+
+	ms, err := NewServer(&ServerConfiguration{URL: "tcp://127.0.0.1:0"}, handler)
+	if err != nil {
+		t.Fatalf("NewServer() failed: %v", err)
+	}
+
+	return ms
+}
+
+// TestMaskWriteRegisterEncoding verifies FC 0x16 applies the AND/OR masks to
+// the current register value and echoes addr/andMask/orMask back unchanged.
+func TestMaskWriteRegisterEncoding(t *testing.T) {
+	handler := newExtendedTestHandler()
+	handler.holdingRegs[10] = 0x0012 // 0b0000_0000_0001_0010
+
+	ms := newDispatchTestServer(t, handler)
+
+	req := &pdu{
+		unitId:       1,
+		functionCode: FC_MASK_WRITE_REGISTER,
+		payload: []byte{
+			0x00, 0x0a, // addr = 10
+			0x00, 0xf2, // AND mask
+			0x00, 0x25, // OR mask
+		},
+	}
+
+	res, _, _, err := ms.dispatchRequest(req, &HandlerContext{})
+	if err != nil {
+		t.Fatalf("dispatchRequest() failed: %v", err)
+	}
+
+	want := []byte{0x00, 0x0a, 0x00, 0xf2, 0x00, 0x25}
+	if string(res.payload) != string(want) {
+		t.Fatalf("unexpected response payload: % x, want % x", res.payload, want)
+	}
+
+	// (0x0012 & 0x00f2) | (0x0025 & ^0x00f2) == 0x0012 | 0x0005 == 0x0017
+	if got := handler.holdingRegs[10]; got != 0x0017 {
+		t.Errorf("unexpected new register value: 0x%04x, want 0x0017", got)
+	}
+}
+
+// TestReadWriteMultipleRegistersEncoding verifies FC 0x17 performs the write
+// half before the read half and encodes the read half byte-exact.
+func TestReadWriteMultipleRegistersEncoding(t *testing.T) {
+	handler := newExtendedTestHandler()
+	handler.holdingRegs[0] = 0xaaaa
+
+	ms := newDispatchTestServer(t, handler)
+
+	req := &pdu{
+		unitId:       1,
+		functionCode: FC_READ_WRITE_MULTIPLE_REGISTERS,
+		payload: []byte{
+			0x00, 0x00, // read addr
+			0x00, 0x01, // read quantity
+			0x00, 0x01, // write addr
+			0x00, 0x01, // write quantity
+			0x02,       // write byte count
+			0xbe, 0xef, // write value
+		},
+	}
+
+	res, _, _, err := ms.dispatchRequest(req, &HandlerContext{})
+	if err != nil {
+		t.Fatalf("dispatchRequest() failed: %v", err)
+	}
+
+	want := []byte{0x02, 0xaa, 0xaa}
+	if string(res.payload) != string(want) {
+		t.Fatalf("unexpected response payload: % x, want % x", res.payload, want)
+	}
+	if handler.holdingRegs[1] != 0xbeef {
+		t.Errorf("write half did not apply: got 0x%04x, want 0xbeef", handler.holdingRegs[1])
+	}
+}
+
+// TestReadFIFOQueueCapsAt31 verifies FC 0x18 truncates a longer FIFO to the
+// 31-register limit mandated by the spec.
+func TestReadFIFOQueueCapsAt31(t *testing.T) {
+	handler := newExtendedTestHandler()
+	for i := uint16(0); i < 40; i++ {
+		handler.fifo = append(handler.fifo, i)
+	}
+
+	ms := newDispatchTestServer(t, handler)
+
+	req := &pdu{
+		unitId:       1,
+		functionCode: FC_READ_FIFO_QUEUE,
+		payload:      []byte{0x00, 0x00},
+	}
+
+	res, _, _, err := ms.dispatchRequest(req, &HandlerContext{})
+	if err != nil {
+		t.Fatalf("dispatchRequest() failed: %v", err)
+	}
+
+	byteCount := bytesToUint16(BIG_ENDIAN, res.payload[0:2])
+	fifoCount := bytesToUint16(BIG_ENDIAN, res.payload[2:4])
+	if fifoCount != 31 {
+		t.Fatalf("expected FIFO count capped at 31, got %v", fifoCount)
+	}
+	if int(byteCount) != 2+2*31 {
+		t.Fatalf("unexpected byte count: %v", byteCount)
+	}
+	if len(res.payload) != 4+2*31 {
+		t.Fatalf("unexpected payload length: %v", len(res.payload))
+	}
+}
+
+// TestFileRecordRoundTrip writes a file record then reads it back, verifying
+// the requested RecordLength is surfaced to the handler and the response is
+// encoded byte-exact.
+func TestFileRecordRoundTrip(t *testing.T) {
+	handler := newExtendedTestHandler()
+	ms := newDispatchTestServer(t, handler)
+
+	writeReq := &pdu{
+		unitId:       1,
+		functionCode: FC_WRITE_FILE_RECORD,
+		payload: []byte{
+			0x0b, // byte count of the single sub-request that follows
+			0x06, // reference type
+			0x00, 0x04, // file number
+			0x00, 0x07, // record number
+			0x00, 0x02, // record length (2 registers)
+			0x12, 0x34, // register 0
+			0x56, 0x78, // register 1
+		},
+	}
+
+	writeRes, _, _, err := ms.dispatchRequest(writeReq, &HandlerContext{})
+	if err != nil {
+		t.Fatalf("write dispatchRequest() failed: %v", err)
+	}
+	// the response echoes the sub-request, but not the leading byte-count
+	// field (which applies to the overall request, not the response)
+	want := writeReq.payload[1:]
+	if string(writeRes.payload) != string(want) {
+		t.Fatalf("write response should echo the sub-request: got % x, want % x",
+			writeRes.payload, want)
+	}
+
+	readReq := &pdu{
+		unitId:       1,
+		functionCode: FC_READ_FILE_RECORD,
+		payload: []byte{
+			0x07,
+			0x06,
+			0x00, 0x04, // file number
+			0x00, 0x07, // record number
+			0x00, 0x02, // record length
+		},
+	}
+
+	readRes, _, _, err := ms.dispatchRequest(readReq, &HandlerContext{})
+	if err != nil {
+		t.Fatalf("read dispatchRequest() failed: %v", err)
+	}
+
+	want = []byte{
+		0x06,       // overall response byte count
+		0x05, 0x06, // sub-response length byte (1 + 2*2) + reference type
+		0x12, 0x34,
+		0x56, 0x78,
+	}
+	if string(readRes.payload) != string(want) {
+		t.Fatalf("unexpected read response payload: % x, want % x", readRes.payload, want)
+	}
+}
+
+// TestDeviceIdentificationPagination verifies that the "more follows"
+// continuation byte and next object id are set once the object list
+// overflows a single PDU, and cleared once the client pages through to the
+// final page.
+func TestDeviceIdentificationPagination(t *testing.T) {
+	handler := newExtendedTestHandler()
+	// 10 objects * (2-byte header + 40-byte value) = 420 bytes, comfortably
+	// over the 240-byte single-PDU cap, forcing at least one continuation
+	for i := uint8(0); i < 10; i++ {
+		value := make([]byte, 40)
+		for j := range value {
+			value[j] = 'a' + i
+		}
+		handler.deviceObjects = append(handler.deviceObjects, DeviceIdentificationObject{
+			Id:    i,
+			Value: value,
+		})
+	}
+
+	ms := newDispatchTestServer(t, handler)
+
+	req := &pdu{
+		unitId:       1,
+		functionCode: FC_ENCAPSULATED_INTERFACE_TRANSPORT,
+		payload:      []byte{MEI_TYPE_READ_DEVICE_IDENTIFICATION, DEVICE_ID_BASIC, 0x00},
+	}
+
+	res, _, _, err := ms.dispatchRequest(req, &HandlerContext{})
+	if err != nil {
+		t.Fatalf("dispatchRequest() failed: %v", err)
+	}
+
+	if res.payload[0] != MEI_TYPE_READ_DEVICE_IDENTIFICATION {
+		t.Fatalf("unexpected MEI type echoed: 0x%02x", res.payload[0])
+	}
+	if res.payload[1] != DEVICE_ID_BASIC {
+		t.Fatalf("expected requested category to be echoed in byte 2, got 0x%02x", res.payload[1])
+	}
+
+	moreFollows := res.payload[3]
+	nextObjectId := res.payload[4]
+	objectCount := res.payload[5]
+
+	if moreFollows != 0xff {
+		t.Fatalf("expected moreFollows to be set, got 0x%02x", moreFollows)
+	}
+	if objectCount == 0 || objectCount >= 10 {
+		t.Fatalf("unexpected object count for a single page: %v", objectCount)
+	}
+	if nextObjectId != objectCount {
+		t.Fatalf("expected nextObjectId to be %v (first object not sent), got %v",
+			objectCount, nextObjectId)
+	}
+
+	// page through using nextObjectId until moreFollows clears
+	for moreFollows == 0xff {
+		req.payload[2] = nextObjectId
+
+		res, _, _, err = ms.dispatchRequest(req, &HandlerContext{})
+		if err != nil {
+			t.Fatalf("paged dispatchRequest() failed: %v", err)
+		}
+		moreFollows = res.payload[3]
+		nextObjectId = res.payload[4]
+	}
+}
@@ -0,0 +1,284 @@
+package modbus
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// mbapHeaderLen is the length, in bytes, of an MBAP header (transaction id,
+// protocol id, length, unit id).
+const mbapHeaderLen int = 7
+
+// pipelinedMBAPTransport is a minimal, self-contained MBAP reader/writer used
+// by handleTransportPipelined. Unlike the regular (serial) tcpTransport, it
+// keeps the transaction ID of each request around so that the matching
+// response can be tagged correctly even when responses complete out of
+// order, and guards writes with a mutex so that two in-flight requests can
+// never interleave their bytes on the wire.
+type pipelinedMBAPTransport struct {
+	conn		net.Conn
+	timeout		time.Duration
+	writeLock	sync.Mutex
+}
+
+// newPipelinedMBAPTransport returns a new pipelinedMBAPTransport wrapping conn.
+func newPipelinedMBAPTransport(conn net.Conn, timeout time.Duration) *pipelinedMBAPTransport {
+	return &pipelinedMBAPTransport{
+		conn:		conn,
+		timeout:	timeout,
+	}
+}
+
+// ReadRequest reads a single MBAP-framed request and returns the decoded PDU
+// along with the transaction ID carried by its header, to be echoed back by
+// WriteResponse once the response is ready.
+func (pt *pipelinedMBAPTransport) ReadRequest() (req *pdu, transactionId uint16, err error) {
+	var header	[mbapHeaderLen]byte
+	var protocolId	uint16
+	var length	uint16
+	var body	[]byte
+
+	if pt.timeout > 0 {
+		pt.conn.SetReadDeadline(time.Now().Add(pt.timeout))
+	}
+
+	if _, err = readFull(pt.conn, header[:]); err != nil {
+		return
+	}
+
+	transactionId	= binary.BigEndian.Uint16(header[0:2])
+	protocolId	= binary.BigEndian.Uint16(header[2:4])
+	length		= binary.BigEndian.Uint16(header[4:6])
+
+	if protocolId != 0 || length < 2 {
+		err = ErrProtocolError
+		return
+	}
+
+	body = make([]byte, length-1)
+	if _, err = readFull(pt.conn, body); err != nil {
+		return
+	}
+
+	req = &pdu{
+		unitId:		header[6],
+		functionCode:	body[0],
+		payload:	body[1:],
+	}
+
+	return
+}
+
+// WriteResponse encodes res as an MBAP frame tagged with transactionId and
+// writes it out, serialized against any other in-flight WriteResponse call on
+// the same connection so that two responses can never interleave mid-frame.
+func (pt *pipelinedMBAPTransport) WriteResponse(res *pdu, transactionId uint16) (err error) {
+	var frame	[]byte
+	var length	uint16
+
+	length	= uint16(2 + len(res.payload))
+
+	frame	= make([]byte, 0, mbapHeaderLen+1+len(res.payload))
+	frame	= appendUint16(frame, transactionId)
+	frame	= appendUint16(frame, 0) // protocol id is always 0 for Modbus/TCP
+	frame	= appendUint16(frame, length)
+	frame	= append(frame, res.unitId, res.functionCode)
+	frame	= append(frame, res.payload...)
+
+	pt.writeLock.Lock()
+	defer pt.writeLock.Unlock()
+
+	if pt.timeout > 0 {
+		pt.conn.SetWriteDeadline(time.Now().Add(pt.timeout))
+	}
+
+	_, err = pt.conn.Write(frame)
+
+	return
+}
+
+// Close closes the underlying connection.
+func (pt *pipelinedMBAPTransport) Close() (err error) {
+	return pt.conn.Close()
+}
+
+// readFull reads exactly len(buf) bytes from conn into buf.
+func readFull(conn net.Conn, buf []byte) (n int, err error) {
+	for n < len(buf) {
+		var nr	int
+
+		nr, err = conn.Read(buf[n:])
+		n += nr
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// appendUint16 appends the big-endian encoding of v to buf.
+func appendUint16(buf []byte, v uint16) []byte {
+	var b	[2]byte
+
+	binary.BigEndian.PutUint16(b[:], v)
+
+	return append(buf, b[:]...)
+}
+
+// isWriteFunctionCode returns true if fc is a function code that mutates
+// server-side state (coils or registers), used to decide which requests need
+// to go through the per-unit write-serialization funnel.
+func isWriteFunctionCode(fc uint8) bool {
+	switch fc {
+	case FC_WRITE_SINGLE_COIL, FC_WRITE_MULTIPLE_COILS,
+	     FC_WRITE_SINGLE_REGISTER, FC_WRITE_MULTIPLE_REGISTERS,
+	     FC_MASK_WRITE_REGISTER, FC_READ_WRITE_MULTIPLE_REGISTERS,
+	     FC_WRITE_FILE_RECORD:
+		return true
+	default:
+		return false
+	}
+}
+
+// unitWriteFunnels serializes concurrent write requests targeting the same
+// unit ID onto a single goroutine at a time, while letting reads (and writes
+// to distinct unit IDs) proceed in parallel.
+type unitWriteFunnels struct {
+	lock	sync.Mutex
+	locks	map[uint8]*sync.Mutex
+}
+
+func newUnitWriteFunnels() *unitWriteFunnels {
+	return &unitWriteFunnels{
+		locks: make(map[uint8]*sync.Mutex),
+	}
+}
+
+// lockFor returns (creating it if necessary) the mutex serializing writes to
+// unitId.
+func (uwf *unitWriteFunnels) lockFor(unitId uint8) *sync.Mutex {
+	uwf.lock.Lock()
+	defer uwf.lock.Unlock()
+
+	lk, found := uwf.locks[unitId]
+	if !found {
+		lk = &sync.Mutex{}
+		uwf.locks[unitId] = lk
+	}
+
+	return lk
+}
+
+// handleTransportPipelined serves sock with up to ms.conf.MaxInFlightPerClient
+// requests dispatched to the handler concurrently, preserving MBAP
+// transaction-ID correlation via pipelinedMBAPTransport and, if
+// ServerConfiguration.SerializeWritesPerUnit is set, funneling writes to the
+// same unit ID through a single goroutine at a time.
+func (ms *ModbusServer) handleTransportPipelined(sock net.Conn, hc *HandlerContext) {
+	var pt		*pipelinedMBAPTransport
+	var sem		chan struct{}
+	var wg		sync.WaitGroup
+	var funnels	*unitWriteFunnels
+	var baseCtx	context.Context
+	var cancelConn	context.CancelFunc
+
+	pt	= newPipelinedMBAPTransport(sock, ms.conf.Timeout)
+	sem	= make(chan struct{}, ms.conf.MaxInFlightPerClient)
+
+	if ms.conf.SerializeWritesPerUnit {
+		funnels = newUnitWriteFunnels()
+	}
+
+	baseCtx	= hc.Context
+	if baseCtx == nil {
+		baseCtx = context.Background()
+	}
+	// cancelled as soon as the read loop below stops (client disconnect,
+	// idle timeout or protocol error), so that in-flight handlers see the
+	// cancellation without the loop first waiting for them to return
+	baseCtx, cancelConn = context.WithCancel(baseCtx)
+	defer cancelConn()
+
+	for {
+		var req			*pdu
+		var transactionId	uint16
+		var err			error
+
+		req, transactionId, err = pt.ReadRequest()
+		if err != nil {
+			break
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func(req *pdu, transactionId uint16) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			var reqHC	HandlerContext
+			var cancel	context.CancelFunc
+			var res		*pdu
+			var derr	error
+			var reqStart	time.Time
+
+			reqHC		= *hc
+			reqHC.UnitId	= req.unitId
+			reqStart	= time.Now()
+
+			if ms.conf.Timeout > 0 {
+				reqHC.Context, cancel = context.WithTimeout(baseCtx, ms.conf.Timeout)
+			} else {
+				reqHC.Context, cancel = context.WithCancel(baseCtx)
+			}
+			defer cancel()
+
+			if funnels != nil && isWriteFunctionCode(req.functionCode) {
+				lk := funnels.lockFor(req.unitId)
+				lk.Lock()
+				defer lk.Unlock()
+			}
+
+			peekAddr, peekQuantity := peekAddrQuantity(req)
+			ms.onRequest(reqHC.Context, req.functionCode, peekAddr, peekQuantity)
+
+			res, _, _, derr = ms.dispatchRequest(req, &reqHC)
+
+			if derr == nil && res == nil {
+				derr = ErrServerDeviceFailure
+			}
+
+			if derr != nil {
+				if derr == ErrProtocolError {
+					ms.logger.Warningf("protocol error, closing link")
+					ms.onResponse(reqHC.Context, req.functionCode, derr, time.Since(reqStart))
+					pt.Close()
+					return
+				}
+				res = &pdu{
+					unitId:		req.unitId,
+					functionCode:	(0x80 | req.functionCode),
+					payload:	[]byte{mapErrorToExceptionCode(derr)},
+				}
+			}
+
+			if ms.conf.Metrics != nil {
+				ms.conf.Metrics.requestServed(req.functionCode, derr, time.Since(reqStart))
+			}
+			ms.onResponse(reqHC.Context, req.functionCode, derr, time.Since(reqStart))
+
+			if err := pt.WriteResponse(res, transactionId); err != nil {
+				ms.logger.Warningf("failed to write response: %v", err)
+			}
+		}(req, transactionId)
+	}
+
+	cancelConn()
+	wg.Wait()
+
+	return
+}
@@ -0,0 +1,114 @@
+package modbus
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBucketBounds are the upper bounds (in microseconds) of the
+// histogram buckets tracked by ServerMetrics, loosely modeled after the
+// default Prometheus histogram buckets.
+var latencyBucketBounds = []int64{100, 500, 1000, 5000, 10000, 50000, 100000, 500000, 1000000}
+
+// ServerMetrics holds a set of Prometheus-style counters and a latency
+// histogram that a ModbusServer updates as it processes traffic, when
+// attached via ServerConfiguration.Metrics. All fields are safe for
+// concurrent use.
+type ServerMetrics struct {
+	activeConnections	int64
+
+	lock			sync.Mutex
+	requestsByFC		map[uint8]uint64
+	exceptionsByFC		map[uint8]uint64
+	latencyBuckets		map[uint8][]uint64	// per-FC, parallel to latencyBucketBounds (+1 for +Inf)
+}
+
+// NewServerMetrics returns a new, empty ServerMetrics instance ready to be
+// attached to a ServerConfiguration.
+func NewServerMetrics() *ServerMetrics {
+	return &ServerMetrics{
+		requestsByFC:	make(map[uint8]uint64),
+		exceptionsByFC:	make(map[uint8]uint64),
+		latencyBuckets:	make(map[uint8][]uint64),
+	}
+}
+
+// connectionOpened increments the active connection gauge.
+func (sm *ServerMetrics) connectionOpened() {
+	atomic.AddInt64(&sm.activeConnections, 1)
+}
+
+// connectionClosed decrements the active connection gauge.
+func (sm *ServerMetrics) connectionClosed() {
+	atomic.AddInt64(&sm.activeConnections, -1)
+}
+
+// ActiveConnections returns the current number of open client connections.
+func (sm *ServerMetrics) ActiveConnections() int64 {
+	return atomic.LoadInt64(&sm.activeConnections)
+}
+
+// requestServed records a completed request: its function code, whether it
+// resulted in a Modbus exception, and how long it took to process.
+func (sm *ServerMetrics) requestServed(fc uint8, err error, elapsed time.Duration) {
+	var micros	int64
+	var bucketIdx	int
+
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+
+	sm.requestsByFC[fc]++
+	if err != nil {
+		sm.exceptionsByFC[fc]++
+	}
+
+	if _, ok := sm.latencyBuckets[fc]; !ok {
+		sm.latencyBuckets[fc] = make([]uint64, len(latencyBucketBounds)+1)
+	}
+
+	micros		= elapsed.Microseconds()
+	bucketIdx	= len(latencyBucketBounds)
+	for i, bound := range latencyBucketBounds {
+		if micros <= bound {
+			bucketIdx = i
+			break
+		}
+	}
+	sm.latencyBuckets[fc][bucketIdx]++
+}
+
+// RequestCount returns the number of requests served for function code fc.
+func (sm *ServerMetrics) RequestCount(fc uint8) uint64 {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+
+	return sm.requestsByFC[fc]
+}
+
+// ExceptionCount returns the number of requests for function code fc that
+// resulted in a Modbus exception response carrying an error from request
+// validation or from the handler. Illegal Function replies to unsupported
+// function codes (or to handler extensions the handler does not implement)
+// are not counted.
+func (sm *ServerMetrics) ExceptionCount(fc uint8) uint64 {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+
+	return sm.exceptionsByFC[fc]
+}
+
+// LatencyBuckets returns a copy of the latency histogram buckets for function
+// code fc, parallel to the upper bounds in latencyBucketBounds (100, 500,
+// 1000, 5000, 10000, 50000, 100000, 500000 and 1000000 microseconds), with a
+// trailing +Inf bucket.
+func (sm *ServerMetrics) LatencyBuckets(fc uint8) []uint64 {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+
+	buckets := sm.latencyBuckets[fc]
+	out := make([]uint64, len(buckets))
+	copy(out, buckets)
+
+	return out
+}
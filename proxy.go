@@ -0,0 +1,277 @@
+package modbus
+
+import (
+	"sync"
+	"time"
+)
+
+// ProxyOptions configures the behavior of a proxy handler returned by
+// NewProxyHandler.
+type ProxyOptions struct {
+	// Upstreams routes requests to a specific upstream client based on the
+	// unit id (slave id) of the incoming request. If a unit id has no entry
+	// here, the client passed to NewProxyHandler is used as the default
+	// upstream.
+	Upstreams	map[uint8]*ModbusClient
+
+	// CacheTTL, if non-zero, enables an in-memory coalescing cache: reads
+	// for the same unit id/function code/address/quantity issued within
+	// CacheTTL of each other are served from a single upstream round trip
+	// rather than one upstream call per incoming request. Writes always
+	// bypass the cache and invalidate any cached entry for the affected
+	// unit id.
+	CacheTTL	time.Duration
+}
+
+// proxyCacheKey identifies a cacheable read.
+type proxyCacheKey struct {
+	unitId		uint8
+	functionCode	uint8
+	addr		uint16
+	quantity	uint16
+}
+
+// proxyCacheEntry holds a cached read result, along with the deadline past
+// which it is no longer valid.
+type proxyCacheEntry struct {
+	bools		[]bool
+	regs		[]uint16
+	err		error
+	expiresAt	time.Time
+}
+
+// proxyUpstream bundles an upstream client with the mutex that serializes
+// access to it: RTU links (and most RS-485 gateways in general) can only
+// carry one outstanding transaction at a time, so concurrent requests
+// targeting the same upstream must queue rather than race on the wire.
+type proxyUpstream struct {
+	client	*ModbusClient
+	lock	sync.Mutex
+}
+
+// proxyHandler implements RequestHandler by forwarding every request to an
+// upstream Modbus device, allowing a single ModbusServer to front a slow bus
+// (typically RS-485/RTU) and multiplex many concurrent TCP masters onto it.
+type proxyHandler struct {
+	defaultUpstream	*proxyUpstream
+	upstreams	map[uint8]*proxyUpstream
+	cacheTTL	time.Duration
+
+	cacheLock	sync.Mutex
+	cache		map[proxyCacheKey]*proxyCacheEntry
+}
+
+// NewProxyHandler returns a RequestHandler which forwards incoming requests
+// to client (or, if opts.Upstreams has an entry for the request's unit id, to
+// that upstream instead), making it possible to run a ModbusServer as a
+// transparent proxy/gateway in front of one or more upstream Modbus devices.
+func NewProxyHandler(client *ModbusClient, opts ProxyOptions) RequestHandler {
+	var ph		*proxyHandler
+	var byClient	map[*ModbusClient]*proxyUpstream
+
+	// dedupe proxyUpstream wrappers by their underlying *ModbusClient: two
+	// unit ids sharing one client (e.g. two slaves on the same RS-485 bus)
+	// must also share the mutex serializing SetUnitId()+read/write pairs
+	// against it, or two masters targeting different unit ids on that bus
+	// can interleave each other's SetUnitId() call with their own request
+	byClient = make(map[*ModbusClient]*proxyUpstream)
+
+	upstreamFor := func(c *ModbusClient) *proxyUpstream {
+		if up, found := byClient[c]; found {
+			return up
+		}
+		up := &proxyUpstream{client: c}
+		byClient[c] = up
+		return up
+	}
+
+	ph = &proxyHandler{
+		defaultUpstream:	upstreamFor(client),
+		upstreams:		make(map[uint8]*proxyUpstream),
+		cacheTTL:		opts.CacheTTL,
+		cache:			make(map[proxyCacheKey]*proxyCacheEntry),
+	}
+
+	for unitId, upstreamClient := range opts.Upstreams {
+		ph.upstreams[unitId]	= upstreamFor(upstreamClient)
+	}
+
+	return ph
+}
+
+// upstreamFor returns the proxyUpstream to use for unitId.
+func (ph *proxyHandler) upstreamFor(unitId uint8) *proxyUpstream {
+	if up, found := ph.upstreams[unitId]; found {
+		return up
+	}
+
+	return ph.defaultUpstream
+}
+
+// cachedRead looks up a previously cached read result for key, invoking load
+// to perform (and cache) the upstream call on a miss. Concurrent requests for
+// the same key that arrive within the TTL are coalesced into a single
+// upstream round trip.
+func (ph *proxyHandler) cachedRead(key proxyCacheKey,
+	load func() (bools []bool, regs []uint16, err error)) (
+	bools []bool, regs []uint16, err error) {
+	if ph.cacheTTL == 0 {
+		return load()
+	}
+
+	ph.cacheLock.Lock()
+
+	if entry, found := ph.cache[key]; found && time.Now().Before(entry.expiresAt) {
+		ph.cacheLock.Unlock()
+		return entry.bools, entry.regs, entry.err
+	}
+
+	ph.cacheLock.Unlock()
+
+	bools, regs, err = load()
+
+	ph.cacheLock.Lock()
+	ph.cache[key] = &proxyCacheEntry{
+		bools:		bools,
+		regs:		regs,
+		err:		err,
+		expiresAt:	time.Now().Add(ph.cacheTTL),
+	}
+	ph.cacheLock.Unlock()
+
+	return
+}
+
+// invalidateCache drops every cached read for unitId, called after any write
+// so that subsequent reads do not observe stale, pre-write data.
+func (ph *proxyHandler) invalidateCache(unitId uint8) {
+	if ph.cacheTTL == 0 {
+		return
+	}
+
+	ph.cacheLock.Lock()
+	for key := range ph.cache {
+		if key.unitId == unitId {
+			delete(ph.cache, key)
+		}
+	}
+	ph.cacheLock.Unlock()
+
+	return
+}
+
+// HandleCoils implements the RequestHandler interface.
+func (ph *proxyHandler) HandleCoils(unitId uint8, addr uint16, quantity uint16,
+	isWrite bool, args []bool) (res []bool, err error) {
+	var up	*proxyUpstream
+
+	up = ph.upstreamFor(unitId)
+
+	up.lock.Lock()
+	defer up.lock.Unlock()
+
+	if err = up.client.SetUnitId(unitId); err != nil {
+		return
+	}
+
+	if isWrite {
+		if len(args) == 1 {
+			err = up.client.WriteCoil(addr, args[0])
+		} else {
+			err = up.client.WriteCoils(addr, args)
+		}
+		ph.invalidateCache(unitId)
+		return
+	}
+
+	res, _, err = ph.cachedRead(
+		proxyCacheKey{unitId, FC_READ_COILS, addr, quantity},
+		func() (bools []bool, regs []uint16, cerr error) {
+			bools, cerr = up.client.ReadCoils(addr, quantity)
+			return
+		})
+
+	return
+}
+
+// HandleDiscreteInputs implements the RequestHandler interface.
+func (ph *proxyHandler) HandleDiscreteInputs(unitId uint8, addr uint16,
+	quantity uint16) (res []bool, err error) {
+	var up	*proxyUpstream
+
+	up = ph.upstreamFor(unitId)
+
+	up.lock.Lock()
+	defer up.lock.Unlock()
+
+	if err = up.client.SetUnitId(unitId); err != nil {
+		return
+	}
+
+	res, _, err = ph.cachedRead(
+		proxyCacheKey{unitId, FC_READ_DISCRETE_INPUTS, addr, quantity},
+		func() (bools []bool, regs []uint16, cerr error) {
+			bools, cerr = up.client.ReadDiscreteInputs(addr, quantity)
+			return
+		})
+
+	return
+}
+
+// HandleHoldingRegisters implements the RequestHandler interface.
+func (ph *proxyHandler) HandleHoldingRegisters(unitId uint8, addr uint16, quantity uint16,
+	isWrite bool, args []uint16) (res []uint16, err error) {
+	var up	*proxyUpstream
+
+	up = ph.upstreamFor(unitId)
+
+	up.lock.Lock()
+	defer up.lock.Unlock()
+
+	if err = up.client.SetUnitId(unitId); err != nil {
+		return
+	}
+
+	if isWrite {
+		if len(args) == 1 {
+			err = up.client.WriteRegister(addr, args[0])
+		} else {
+			err = up.client.WriteRegisters(addr, args)
+		}
+		ph.invalidateCache(unitId)
+		return
+	}
+
+	_, res, err = ph.cachedRead(
+		proxyCacheKey{unitId, FC_READ_HOLDING_REGISTERS, addr, quantity},
+		func() (bools []bool, regs []uint16, cerr error) {
+			regs, cerr = up.client.ReadHoldingRegisters(addr, quantity)
+			return
+		})
+
+	return
+}
+
+// HandleInputRegisters implements the RequestHandler interface.
+func (ph *proxyHandler) HandleInputRegisters(unitId uint8, addr uint16,
+	quantity uint16) (res []uint16, err error) {
+	var up	*proxyUpstream
+
+	up = ph.upstreamFor(unitId)
+
+	up.lock.Lock()
+	defer up.lock.Unlock()
+
+	if err = up.client.SetUnitId(unitId); err != nil {
+		return
+	}
+
+	_, res, err = ph.cachedRead(
+		proxyCacheKey{unitId, FC_READ_INPUT_REGISTERS, addr, quantity},
+		func() (bools []bool, regs []uint16, cerr error) {
+			regs, cerr = up.client.ReadInputRegisters(addr, quantity)
+			return
+		})
+
+	return
+}
@@ -0,0 +1,365 @@
+package modbus
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingHandler wraps a memoryHandler and counts how many holding register
+// reads actually reach it, so tests can assert on cache hits/misses
+// without being able to observe the proxy's internal cache directly.
+type countingHandler struct {
+	*memoryHandler
+
+	reads	int64
+}
+
+func (ch *countingHandler) HandleHoldingRegisters(unitId uint8, addr uint16, quantity uint16,
+	isWrite bool, args []uint16) (res []uint16, err error) {
+	if !isWrite {
+		atomic.AddInt64(&ch.reads, 1)
+	}
+	return ch.memoryHandler.HandleHoldingRegisters(unitId, addr, quantity, isWrite, args)
+}
+
+// startUpstreamServer starts a plain ModbusServer over TCP in front of
+// handler and returns a client dialed into it, for use as a proxyHandler
+// upstream.
+func startUpstreamServer(t *testing.T, handler RequestHandler) (client *ModbusClient, stop func()) {
+	t.Helper()
+
+	addr := freeTCPAddr(t)
+	server, err := NewServer(&ServerConfiguration{URL: addr, Timeout: time.Second}, handler)
+	if err != nil {
+		t.Fatalf("NewServer(upstream) failed: %v", err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("upstream Start() failed: %v", err)
+	}
+
+	client, err = NewClient(&ClientConfiguration{URL: addr, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("NewClient(upstream) failed: %v", err)
+	}
+	if err := client.Open(); err != nil {
+		t.Fatalf("upstream client Open() failed: %v", err)
+	}
+
+	return client, func() {
+		client.Close()
+		server.Stop()
+	}
+}
+
+// TestProxyRoundTripBackToBackServers spins up two ModbusServers back to
+// back -- an "upstream" device served directly by a memoryHandler, and a
+// "gateway" in front of it serving a proxyHandler that forwards every
+// request to the upstream -- and verifies that register writes/reads round
+// trip byte-exact through the gateway and that upstream exceptions are
+// passed back to the gateway's client unchanged.
+func TestProxyRoundTripBackToBackServers(t *testing.T) {
+	upstreamHandler := newMemoryHandler()
+	upstreamHandler.exceptionAddrs[100] = true
+
+	upstreamAddr := freeTCPAddr(t)
+	upstreamServer, err := NewServer(&ServerConfiguration{
+		URL:     upstreamAddr,
+		Timeout: time.Second,
+	}, upstreamHandler)
+	if err != nil {
+		t.Fatalf("NewServer(upstream) failed: %v", err)
+	}
+	if err := upstreamServer.Start(); err != nil {
+		t.Fatalf("upstream Start() failed: %v", err)
+	}
+	defer upstreamServer.Stop()
+
+	upstreamClient, err := NewClient(&ClientConfiguration{
+		URL:     upstreamAddr,
+		Timeout: time.Second,
+	})
+	if err != nil {
+		t.Fatalf("NewClient(upstream) failed: %v", err)
+	}
+	if err := upstreamClient.Open(); err != nil {
+		t.Fatalf("upstream client Open() failed: %v", err)
+	}
+	defer upstreamClient.Close()
+
+	gatewayAddr := freeTCPAddr(t)
+	gatewayServer, err := NewServer(&ServerConfiguration{
+		URL:     gatewayAddr,
+		Timeout: time.Second,
+	}, NewProxyHandler(upstreamClient, ProxyOptions{}))
+	if err != nil {
+		t.Fatalf("NewServer(gateway) failed: %v", err)
+	}
+	if err := gatewayServer.Start(); err != nil {
+		t.Fatalf("gateway Start() failed: %v", err)
+	}
+	defer gatewayServer.Stop()
+
+	gatewayClient, err := NewClient(&ClientConfiguration{
+		URL:     gatewayAddr,
+		Timeout: time.Second,
+	})
+	if err != nil {
+		t.Fatalf("NewClient(gateway) failed: %v", err)
+	}
+	if err := gatewayClient.Open(); err != nil {
+		t.Fatalf("gateway client Open() failed: %v", err)
+	}
+	defer gatewayClient.Close()
+
+	want := []uint16{0x1234, 0xbeef, 0x0042, 0xffff}
+	if err := gatewayClient.WriteRegisters(10, want); err != nil {
+		t.Fatalf("WriteRegisters() through gateway failed: %v", err)
+	}
+
+	got, err := gatewayClient.ReadHoldingRegisters(10, uint16(len(want)))
+	if err != nil {
+		t.Fatalf("ReadHoldingRegisters() through gateway failed: %v", err)
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("register count mismatch: got %v, want %v", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("register %v: got 0x%04x, want 0x%04x", i, got[i], want[i])
+		}
+	}
+
+	// confirm the values landed on the upstream device itself, not just in
+	// some gateway-side cache
+	directRead, err := upstreamClient.ReadHoldingRegisters(10, uint16(len(want)))
+	if err != nil {
+		t.Fatalf("ReadHoldingRegisters() direct to upstream failed: %v", err)
+	}
+	for i := range want {
+		if directRead[i] != want[i] {
+			t.Errorf("upstream register %v: got 0x%04x, want 0x%04x", i, directRead[i], want[i])
+		}
+	}
+
+	// exceptions raised by the upstream handler must surface through the
+	// gateway unchanged
+	if _, err := gatewayClient.ReadHoldingRegisters(100, 1); err != ErrIllegalDataAddress {
+		t.Errorf("expected ErrIllegalDataAddress through gateway, got %v", err)
+	}
+}
+
+// TestProxyCacheCoalescesReads verifies that repeated reads of the same
+// unit id/address/quantity within CacheTTL are served from the cache (a
+// single upstream round trip), and that a write in between invalidates the
+// cached entry so the next read goes back to the upstream.
+func TestProxyCacheCoalescesReads(t *testing.T) {
+	upstreamHandler := &countingHandler{memoryHandler: newMemoryHandler()}
+	upstreamHandler.holdingRegs[10] = 0x1111
+
+	upstreamClient, stopUpstream := startUpstreamServer(t, upstreamHandler)
+	defer stopUpstream()
+
+	gatewayAddr := freeTCPAddr(t)
+	gatewayServer, err := NewServer(&ServerConfiguration{
+		URL:     gatewayAddr,
+		Timeout: time.Second,
+	}, NewProxyHandler(upstreamClient, ProxyOptions{CacheTTL: time.Minute}))
+	if err != nil {
+		t.Fatalf("NewServer(gateway) failed: %v", err)
+	}
+	if err := gatewayServer.Start(); err != nil {
+		t.Fatalf("gateway Start() failed: %v", err)
+	}
+	defer gatewayServer.Stop()
+
+	gatewayClient, err := NewClient(&ClientConfiguration{URL: gatewayAddr, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("NewClient(gateway) failed: %v", err)
+	}
+	if err := gatewayClient.Open(); err != nil {
+		t.Fatalf("gateway client Open() failed: %v", err)
+	}
+	defer gatewayClient.Close()
+
+	for i := 0; i < 5; i++ {
+		regs, err := gatewayClient.ReadHoldingRegisters(10, 1)
+		if err != nil {
+			t.Fatalf("ReadHoldingRegisters() #%v failed: %v", i, err)
+		}
+		if regs[0] != 0x1111 {
+			t.Fatalf("ReadHoldingRegisters() #%v = 0x%04x, want 0x1111", i, regs[0])
+		}
+	}
+	if got := atomic.LoadInt64(&upstreamHandler.reads); got != 1 {
+		t.Errorf("expected 5 identical reads to coalesce into 1 upstream read, got %v", got)
+	}
+
+	if err := gatewayClient.WriteRegister(10, 0x2222); err != nil {
+		t.Fatalf("WriteRegister() failed: %v", err)
+	}
+
+	regs, err := gatewayClient.ReadHoldingRegisters(10, 1)
+	if err != nil {
+		t.Fatalf("ReadHoldingRegisters() after write failed: %v", err)
+	}
+	if regs[0] != 0x2222 {
+		t.Fatalf("ReadHoldingRegisters() after write = 0x%04x, want 0x2222 (stale cache?)", regs[0])
+	}
+	if got := atomic.LoadInt64(&upstreamHandler.reads); got != 2 {
+		t.Errorf("expected the write to invalidate the cache, forcing a 2nd upstream read, got %v reads", got)
+	}
+}
+
+// TestProxyPerUnitRouting verifies that ProxyOptions.Upstreams routes a
+// request for a given unit id to the matching upstream client, while any
+// other unit id falls back to the default upstream passed to
+// NewProxyHandler.
+func TestProxyPerUnitRouting(t *testing.T) {
+	defaultUpstreamHandler := newMemoryHandler()
+	defaultUpstreamHandler.holdingRegs[0] = 0xaaaa
+	defaultUpstreamClient, stopDefault := startUpstreamServer(t, defaultUpstreamHandler)
+	defer stopDefault()
+
+	otherUpstreamHandler := newMemoryHandler()
+	otherUpstreamHandler.holdingRegs[0] = 0xbbbb
+	otherUpstreamClient, stopOther := startUpstreamServer(t, otherUpstreamHandler)
+	defer stopOther()
+
+	gatewayAddr := freeTCPAddr(t)
+	gatewayServer, err := NewServer(&ServerConfiguration{
+		URL:     gatewayAddr,
+		Timeout: time.Second,
+	}, NewProxyHandler(defaultUpstreamClient, ProxyOptions{
+		Upstreams: map[uint8]*ModbusClient{2: otherUpstreamClient},
+	}))
+	if err != nil {
+		t.Fatalf("NewServer(gateway) failed: %v", err)
+	}
+	if err := gatewayServer.Start(); err != nil {
+		t.Fatalf("gateway Start() failed: %v", err)
+	}
+	defer gatewayServer.Stop()
+
+	gatewayClient, err := NewClient(&ClientConfiguration{URL: gatewayAddr, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("NewClient(gateway) failed: %v", err)
+	}
+	if err := gatewayClient.Open(); err != nil {
+		t.Fatalf("gateway client Open() failed: %v", err)
+	}
+	defer gatewayClient.Close()
+
+	if err := gatewayClient.SetUnitId(1); err != nil {
+		t.Fatalf("SetUnitId(1) failed: %v", err)
+	}
+	regs, err := gatewayClient.ReadHoldingRegisters(0, 1)
+	if err != nil {
+		t.Fatalf("ReadHoldingRegisters() for unit 1 failed: %v", err)
+	}
+	if regs[0] != 0xaaaa {
+		t.Errorf("unit 1 (no Upstreams entry) = 0x%04x, want default upstream's 0xaaaa", regs[0])
+	}
+
+	if err := gatewayClient.SetUnitId(2); err != nil {
+		t.Fatalf("SetUnitId(2) failed: %v", err)
+	}
+	regs, err = gatewayClient.ReadHoldingRegisters(0, 1)
+	if err != nil {
+		t.Fatalf("ReadHoldingRegisters() for unit 2 failed: %v", err)
+	}
+	if regs[0] != 0xbbbb {
+		t.Errorf("unit 2 (routed via Upstreams) = 0x%04x, want other upstream's 0xbbbb", regs[0])
+	}
+}
+
+// unitScopedHandler wraps a memoryHandler and gives every unit id its own
+// block of 0x100 holding registers, so that requests carrying different unit
+// ids never touch the same register on the upstream device.
+type unitScopedHandler struct {
+	*memoryHandler
+}
+
+func (uh *unitScopedHandler) HandleHoldingRegisters(unitId uint8, addr uint16, quantity uint16,
+	isWrite bool, args []uint16) (res []uint16, err error) {
+	return uh.memoryHandler.HandleHoldingRegisters(unitId, uint16(unitId)<<8+addr, quantity, isWrite, args)
+}
+
+// TestProxyUpstreamSerializesSharedClient verifies that two unit ids routed
+// to the *same* underlying *ModbusClient share one upstream lock: concurrent
+// requests for those unit ids must never interleave their SetUnitId()+
+// read/write pairs against the shared client, which would otherwise let one
+// request observe or mutate the other's unit id mid-flight.
+func TestProxyUpstreamSerializesSharedClient(t *testing.T) {
+	upstreamHandler := &unitScopedHandler{memoryHandler: newMemoryHandler()}
+
+	upstreamClient, stopUpstream := startUpstreamServer(t, upstreamHandler)
+	defer stopUpstream()
+
+	gatewayAddr := freeTCPAddr(t)
+	gatewayServer, err := NewServer(&ServerConfiguration{
+		URL:     gatewayAddr,
+		Timeout: time.Second,
+	}, NewProxyHandler(upstreamClient, ProxyOptions{
+		Upstreams: map[uint8]*ModbusClient{
+			1: upstreamClient,
+			2: upstreamClient,
+		},
+	}))
+	if err != nil {
+		t.Fatalf("NewServer(gateway) failed: %v", err)
+	}
+	if err := gatewayServer.Start(); err != nil {
+		t.Fatalf("gateway Start() failed: %v", err)
+	}
+	defer gatewayServer.Stop()
+
+	const nIterations = 200
+	var wg sync.WaitGroup
+
+	runUnit := func(unitId uint8, value uint16) {
+		defer wg.Done()
+
+		client, err := NewClient(&ClientConfiguration{URL: gatewayAddr, Timeout: time.Second})
+		if err != nil {
+			t.Errorf("NewClient() failed: %v", err)
+			return
+		}
+		defer client.Close()
+		if err := client.Open(); err != nil {
+			t.Errorf("client Open() failed: %v", err)
+			return
+		}
+		if err := client.SetUnitId(unitId); err != nil {
+			t.Errorf("SetUnitId(%v) failed: %v", unitId, err)
+			return
+		}
+
+		for i := 0; i < nIterations; i++ {
+			if err := client.WriteRegister(0, value); err != nil {
+				t.Errorf("unit %v: WriteRegister() failed: %v", unitId, err)
+				return
+			}
+			regs, err := client.ReadHoldingRegisters(0, 1)
+			if err != nil {
+				t.Errorf("unit %v: ReadHoldingRegisters() failed: %v", unitId, err)
+				return
+			}
+			// if the shared client's SetUnitId() were not serialized against
+			// the other goroutine's, this read could race with the other
+			// unit id's SetUnitId() call and observe the wrong value
+			if regs[0] != value {
+				t.Errorf("unit %v: read back 0x%04x after writing 0x%04x (interleaved upstream access?)",
+					unitId, regs[0], value)
+				return
+			}
+		}
+	}
+
+	wg.Add(2)
+	go runUnit(1, 0x1234)
+	go runUnit(2, 0x5678)
+	wg.Wait()
+}
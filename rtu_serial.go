@@ -0,0 +1,22 @@
+package modbus
+
+import (
+	"io"
+
+	"github.com/goburrow/serial"
+)
+
+// openSerialPort opens and configures the serial device at devicePath for use
+// by an RTU listener.
+func openSerialPort(devicePath string, speed uint, dataBits uint,
+	parity string, stopBits uint) (port io.ReadWriteCloser, err error) {
+	port, err = serial.Open(&serial.Config{
+		Address:	devicePath,
+		BaudRate:	int(speed),
+		DataBits:	int(dataBits),
+		Parity:		parity,
+		StopBits:	int(stopBits),
+	})
+
+	return
+}
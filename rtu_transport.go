@@ -0,0 +1,222 @@
+package modbus
+
+import (
+	"io"
+	"time"
+)
+
+// RTU_SERVER_TRANSPORT identifies a server listening on a local serial device,
+// framing requests as Modbus RTU (slave id + PDU + CRC-16).
+// RTU_SERVER_OVER_TCP_TRANSPORT identifies a server listening on a TCP socket but
+// still framing requests as Modbus RTU, as emitted by cheap TCP-to-serial
+// gateways.
+const (
+	RTU_SERVER_TRANSPORT		transportType	= TCP_TLS_TRANSPORT + 1
+	RTU_SERVER_OVER_TCP_TRANSPORT	transportType	= TCP_TLS_TRANSPORT + 2
+)
+
+// rtuCRCPoly is the generator polynomial used by the Modbus RTU CRC-16
+// (reflected form of 0x8005).
+const rtuCRCPoly	uint16	= 0xA001
+
+// rtuMaxADULen is the largest possible RTU ADU: 1 (slave id) + 253 (max PDU) + 2 (CRC).
+const rtuMaxADULen	int	= 256
+
+// serverRTUTransport implements the transport interface over a serial device or a
+// TCP socket carrying Modbus RTU-framed requests (slave id + PDU + CRC-16),
+// as opposed to the MBAP-framed tcpTransport.
+type serverRTUTransport struct {
+	conn		io.ReadWriteCloser
+	timeout		time.Duration
+	frameSilence	time.Duration	// minimum idle time marking an RTU frame boundary
+	logger		*logger
+}
+
+// newServerRTUTransport returns a new RTU transport wrapping conn (a serial port or
+// a TCP connection fed by an RTU-to-TCP bridge). speed is the serial baud
+// rate in bits per second and is used to derive the mandatory 3.5-character
+// inter-frame silence; if speed is 0 (e.g. rtuovertcp:// links, which have no
+// inherent character timing), a conservative fixed silence window is used
+// instead.
+func newServerRTUTransport(conn io.ReadWriteCloser, speed uint, timeout time.Duration) (rt *serverRTUTransport) {
+	rt = &serverRTUTransport{
+		conn:		conn,
+		timeout:	timeout,
+		logger:		newLogger("rtu-transport"),
+	}
+
+	if speed > 0 {
+		// 11 bits per character (1 start bit + 8 data bits + 1 parity
+		// bit + 1 stop bit), 3.5 character times
+		rt.frameSilence	= time.Duration(float64(time.Second) * 3.5 * 11 / float64(speed))
+		// the spec floors the silence at 1.75ms for baud rates above 19200
+		if rt.frameSilence < 1750*time.Microsecond {
+			rt.frameSilence = 1750 * time.Microsecond
+		}
+	} else {
+		rt.frameSilence	= 3500 * time.Microsecond
+	}
+
+	return
+}
+
+// ReadRequest reads a single RTU-framed request off the wire, waiting for the
+// inter-frame silence to mark its end, then validates the CRC and unwraps the
+// PDU. Frames with a bad CRC are silently dropped (as required by the RTU
+// spec, since there is no reliable way to tell where the next frame starts)
+// and reading resumes; any I/O error is returned as-is.
+func (rt *serverRTUTransport) ReadRequest() (req *pdu, err error) {
+	var adu	[]byte
+
+	for {
+		adu, err = rt.readFrame()
+		if err != nil {
+			return
+		}
+
+		if len(adu) < 4 {
+			// too short to contain a unit id, function code and CRC:
+			// discard and wait for the next frame
+			continue
+		}
+
+		if !rtuCRCValid(adu) {
+			rt.logger.Warningf("dropping RTU frame with invalid CRC")
+			continue
+		}
+
+		req = &pdu{
+			unitId:		adu[0],
+			functionCode:	adu[1],
+			payload:	adu[2 : len(adu)-2],
+		}
+
+		return
+	}
+}
+
+// WriteResponse encodes res as an RTU ADU (unit id + PDU + CRC-16) and writes
+// it to the wire, unless res targets the broadcast address (unit id 0), in
+// which case the Modbus spec mandates that no response be sent at all.
+func (rt *serverRTUTransport) WriteResponse(res *pdu) (err error) {
+	var adu	[]byte
+
+	if res.unitId == 0 {
+		// broadcast request: the spec forbids responding
+		return
+	}
+
+	adu	= append(adu, res.unitId, res.functionCode)
+	adu	= append(adu, res.payload...)
+	adu	= append(adu, rtuCRCBytes(adu)...)
+
+	if rt.timeout > 0 {
+		if deadlineConn, ok := rt.conn.(interface {
+			SetWriteDeadline(t time.Time) error
+		}); ok {
+			deadlineConn.SetWriteDeadline(time.Now().Add(rt.timeout))
+		}
+	}
+
+	_, err	= rt.conn.Write(adu)
+
+	return
+}
+
+// Close closes the underlying serial device or TCP connection.
+func (rt *serverRTUTransport) Close() (err error) {
+	return rt.conn.Close()
+}
+
+// readFrame reads bytes off the wire until rt.frameSilence has elapsed with no
+// new data, which the RTU spec defines as the end of a frame.
+func (rt *serverRTUTransport) readFrame() (frame []byte, err error) {
+	var buf		[]byte
+	var n		int
+	var single	[rtuMaxADULen]byte
+
+	buf	= make([]byte, 0, rtuMaxADULen)
+
+	for {
+		if deadlineConn, ok := rt.conn.(interface {
+			SetReadDeadline(t time.Time) error
+		}); ok {
+			if len(buf) == 0 && rt.timeout > 0 {
+				// waiting for the start of a new frame: honor the
+				// configured idle session timeout
+				deadlineConn.SetReadDeadline(time.Now().Add(rt.timeout))
+			} else {
+				// mid-frame: the next byte must arrive within the
+				// inter-frame silence window, otherwise the frame
+				// is considered complete
+				deadlineConn.SetReadDeadline(time.Now().Add(rt.frameSilence))
+			}
+		}
+
+		n, err = rt.conn.Read(single[:])
+		if err != nil {
+			if len(buf) > 0 && isTimeoutErr(err) {
+				// silence reached: the frame accumulated so far is complete
+				frame	= buf
+				err	= nil
+				return
+			}
+			return
+		}
+
+		buf	= append(buf, single[:n]...)
+		if len(buf) >= rtuMaxADULen {
+			frame	= buf
+			return
+		}
+	}
+}
+
+// rtuCRCValid returns true if the trailing 2 bytes of adu match the Modbus
+// CRC-16 of the leading bytes.
+func rtuCRCValid(adu []byte) bool {
+	var want	uint16
+	var got		uint16
+
+	want	= bytesToUint16(LITTLE_ENDIAN, adu[len(adu)-2:])
+	got	= rtuCRC(adu[:len(adu)-2])
+
+	return want == got
+}
+
+// rtuCRCBytes returns the little-endian encoding of the Modbus CRC-16 of data.
+func rtuCRCBytes(data []byte) []byte {
+	return uint16ToBytes(LITTLE_ENDIAN, rtuCRC(data))
+}
+
+// rtuCRC computes the Modbus RTU CRC-16 (poly 0xA001, reflected, init 0xFFFF)
+// of data.
+func rtuCRC(data []byte) (crc uint16) {
+	crc = 0xFFFF
+
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&0x0001 != 0 {
+				crc = (crc >> 1) ^ rtuCRCPoly
+			} else {
+				crc = crc >> 1
+			}
+		}
+	}
+
+	return
+}
+
+// isTimeoutErr returns true if err is a network/serial timeout error.
+func isTimeoutErr(err error) bool {
+	type timeouter interface {
+		Timeout() bool
+	}
+
+	if te, ok := err.(timeouter); ok {
+		return te.Timeout()
+	}
+
+	return false
+}
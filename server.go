@@ -1,7 +1,12 @@
 package modbus
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
 	"fmt"
+	"io"
 	"time"
 	"net"
 	"strings"
@@ -14,6 +19,68 @@ type ServerConfiguration struct {
 	Timeout		time.Duration	// idle session timeout (client connection will be
 					// closed if idle for this long)
 	MaxClients	uint		// maximum number of concurrent client connections
+
+	// TLSConfig holds the TLS server configuration used when URL specifies
+	// the tcp+tls:// (a.k.a. tcps://) scheme: server certificate/key
+	// (Certificates), an optional client CA pool to request and verify
+	// client certificates against (ClientCAs/ClientAuth, for mTLS) and the
+	// minimum accepted protocol version (MinVersion). Ignored for plain
+	// tcp:// listeners.
+	TLSConfig	*tls.Config
+
+	// TLSRoleOID, if set, is the ASN.1 object identifier of a certificate
+	// extension carrying the client's authorized role. When unset, the
+	// client certificate's Common Name is used as the role instead.
+	TLSRoleOID	asn1.ObjectIdentifier
+
+	// Speed, DataBits, Parity and StopBits configure the serial link used by
+	// rtu:// listeners (ignored otherwise). Speed is expressed in bits per
+	// second (e.g. 9600, 19200, 115200), DataBits is typically 7 or 8,
+	// Parity is one of "N" (none), "E" (even) or "O" (odd), and StopBits is
+	// 1 or 2. All default to 19200/8/N/1 if left unset.
+	Speed		uint
+	DataBits	uint
+	Parity		string
+	StopBits	uint
+
+	// OnAccept, if set, is invoked right after a client connection is
+	// accepted (after the TLS handshake, if any), before any request is
+	// served. OnClose is invoked once the connection is torn down.
+	OnAccept	func(ctx context.Context)
+	OnClose		func(ctx context.Context)
+
+	// OnRequest, if set, is invoked after a request has been decoded but
+	// before the handler is called. OnResponse is invoked once the handler
+	// has returned (err is nil for a successful response, the handler/
+	// protocol error otherwise, and elapsed is the time spent in the
+	// handler). Illegal Function replies to function codes that the server
+	// or the handler does not support are also reported with a nil err.
+	OnRequest	func(ctx context.Context, fc uint8, addr uint16, quantity uint16)
+	OnResponse	func(ctx context.Context, fc uint8, err error, elapsed time.Duration)
+
+	// Metrics, if set, is updated with per-function-code request/exception
+	// counts, active connection counts and request latency as the server
+	// processes traffic. See NewServerMetrics().
+	Metrics		*ServerMetrics
+
+	// MaxInFlightPerClient, if greater than 1, allows up to that many
+	// requests from a single TCP master to be dispatched to the handler
+	// concurrently rather than one at a time, taking advantage of masters
+	// that pipeline requests under distinct MBAP transaction IDs. Requests
+	// are still read off the wire one at a time (reading is cheap and must
+	// stay in order), but handler execution and response encoding run in a
+	// bounded worker pool, and responses are written back tagged with their
+	// original transaction ID so they may complete out of order. Only
+	// applies to tcp:// and tcp+tls:// listeners; ignored otherwise. Leave
+	// at 0 (or 1) to keep the default strictly serial behavior.
+	MaxInFlightPerClient	uint
+
+	// SerializeWritesPerUnit, when MaxInFlightPerClient > 1, funnels writes
+	// targeting the same unit ID on a given client connection through a
+	// single goroutine at a time, while reads (and writes to distinct unit
+	// IDs) continue to run concurrently. Writes arriving over different
+	// client connections are not serialized against each other.
+	SerializeWritesPerUnit	bool
 }
 
 // The RequestHandler interface should be implemented by the handler
@@ -105,6 +172,46 @@ type RequestHandler interface {
 				 res []uint16, err error)
 }
 
+// HandlerContext carries per-request metadata that is not part of the Modbus
+// protocol itself but that a RequestHandlerCtx implementation may want to use
+// to make access control decisions (e.g. enforcing per-role read/write
+// permissions on a tcp+tls:// listener).
+type HandlerContext struct {
+	Context		context.Context	// cancelled when the per-request deadline
+					// (ServerConfiguration.Timeout) is exceeded or the
+					// connection stops being served, whichever comes
+					// first; a pipelined connection (MaxInFlightPerClient
+					// > 1) cancels in-flight requests as soon as the
+					// client disconnects, while a strictly serial one
+					// only notices the disconnect after the current
+					// request has been served
+	ClientAddr	net.Addr	// address of the client issuing the request
+	TLSRole		string		// role derived from the client cert, if any (mTLS only)
+	TLSPeerCert	*x509.Certificate // client cert, if any (mTLS only)
+	UnitId		uint8		// unit id (slave id) targeted by the current request
+}
+
+// RequestHandlerCtx is an optional companion to RequestHandler. Handlers which
+// need to know which client/role a request originated from (typically to
+// enforce per-role access to coils and registers on a mutually-authenticated
+// tcp+tls:// listener) should implement it in addition to RequestHandler; the
+// server favors the Ctx variant of each method when the handler provides both.
+type RequestHandlerCtx interface {
+	HandleCoilsCtx		(hc *HandlerContext, unitId uint8, addr uint16, quantity uint16,
+				 isWrite bool, args []bool) (
+				 res []bool, err error)
+
+	HandleDiscreteInputsCtx	(hc *HandlerContext, unitId uint8, addr uint16, quantity uint16) (
+				 res []bool, err error)
+
+	HandleHoldingRegistersCtx (hc *HandlerContext, unitId uint8, addr uint16, quantity uint16,
+				 isWrite bool, args []uint16) (
+				 res []uint16, err error)
+
+	HandleInputRegistersCtx	(hc *HandlerContext, unitId uint8, addr uint16, quantity uint16) (
+				 res []uint16, err error)
+}
+
 // Modbus server object.
 type ModbusServer struct {
 	conf		ServerConfiguration
@@ -112,8 +219,10 @@ type ModbusServer struct {
 	lock		sync.Mutex
 	started		bool
 	handler		RequestHandler
+	handlerCtx	RequestHandlerCtx	// set if handler also implements RequestHandlerCtx
 	tcpListener	net.Listener
 	tcpClients	[]net.Conn
+	serialPort	io.ReadWriteCloser	// open serial device, for RTU_SERVER_TRANSPORT only
 	transportType	transportType
 }
 
@@ -127,6 +236,12 @@ func NewServer(conf *ServerConfiguration, reqHandler RequestHandler) (ms *Modbus
 		logger:		newLogger("modbus-server"),
 	}
 
+	// if the handler also implements RequestHandlerCtx, prefer it so that
+	// per-request context (client address, TLS role) is made available
+	if handlerCtx, ok := reqHandler.(RequestHandlerCtx); ok {
+		ms.handlerCtx	= handlerCtx
+	}
+
 	switch {
 	case strings.HasPrefix(ms.conf.URL, "tcp://"):
 		ms.conf.URL	= strings.TrimPrefix(ms.conf.URL, "tcp://")
@@ -141,6 +256,68 @@ func NewServer(conf *ServerConfiguration, reqHandler RequestHandler) (ms *Modbus
 
 		ms.transportType	= TCP_TRANSPORT
 
+	case strings.HasPrefix(ms.conf.URL, "tcp+tls://"):
+		ms.conf.URL	= strings.TrimPrefix(ms.conf.URL, "tcp+tls://")
+
+		err	= ms.validateTLSConfig()
+		if err != nil {
+			return
+		}
+
+		if ms.conf.Timeout == 0 {
+			ms.conf.Timeout = 120 * time.Second
+		}
+
+		if ms.conf.MaxClients == 0 {
+			ms.conf.MaxClients = 10
+		}
+
+		ms.transportType	= TCP_TLS_TRANSPORT
+
+	case strings.HasPrefix(ms.conf.URL, "tcps://"):
+		ms.conf.URL	= strings.TrimPrefix(ms.conf.URL, "tcps://")
+
+		err	= ms.validateTLSConfig()
+		if err != nil {
+			return
+		}
+
+		if ms.conf.Timeout == 0 {
+			ms.conf.Timeout = 120 * time.Second
+		}
+
+		if ms.conf.MaxClients == 0 {
+			ms.conf.MaxClients = 10
+		}
+
+		ms.transportType	= TCP_TLS_TRANSPORT
+
+	case strings.HasPrefix(ms.conf.URL, "rtu://"):
+		ms.conf.URL	= strings.TrimPrefix(ms.conf.URL, "rtu://")
+
+		ms.applySerialDefaults()
+
+		if ms.conf.Timeout == 0 {
+			ms.conf.Timeout = 5 * time.Second
+		}
+
+		ms.transportType	= RTU_SERVER_TRANSPORT
+
+	case strings.HasPrefix(ms.conf.URL, "rtuovertcp://"):
+		ms.conf.URL	= strings.TrimPrefix(ms.conf.URL, "rtuovertcp://")
+
+		ms.applySerialDefaults()
+
+		if ms.conf.Timeout == 0 {
+			ms.conf.Timeout = 120 * time.Second
+		}
+
+		if ms.conf.MaxClients == 0 {
+			ms.conf.MaxClients = 10
+		}
+
+		ms.transportType	= RTU_SERVER_OVER_TCP_TRANSPORT
+
 	default:
 		err	= ErrConfigurationError
 		return
@@ -151,6 +328,28 @@ func NewServer(conf *ServerConfiguration, reqHandler RequestHandler) (ms *Modbus
 	return
 }
 
+// applySerialDefaults fills in the serial link parameters of a rtu:// or
+// rtuovertcp:// listener with their usual defaults, wherever left unset.
+func (ms *ModbusServer) applySerialDefaults() {
+	if ms.conf.Speed == 0 {
+		ms.conf.Speed = 19200
+	}
+
+	if ms.conf.DataBits == 0 {
+		ms.conf.DataBits = 8
+	}
+
+	if ms.conf.Parity == "" {
+		ms.conf.Parity = "N"
+	}
+
+	if ms.conf.StopBits == 0 {
+		ms.conf.StopBits = 1
+	}
+
+	return
+}
+
 // Starts accepting client connections.
 func (ms *ModbusServer) Start() (err error) {
 	ms.lock.Lock()
@@ -171,6 +370,42 @@ func (ms *ModbusServer) Start() (err error) {
 		// accept client connections in a goroutine
 		go ms.acceptTCPClients()
 
+	case TCP_TLS_TRANSPORT:
+		// bind to a TCP socket and wrap it with a TLS listener so that
+		// each accepted connection requires a successful handshake
+		// (and, if ClientAuth/ClientCAs are set, a valid client cert)
+		// before any Modbus traffic is exchanged.
+		ms.tcpListener, err	= tls.Listen("tcp", ms.conf.URL, ms.conf.TLSConfig)
+		if err != nil {
+			return
+		}
+
+		// accept client connections in a goroutine
+		go ms.acceptTCPClients()
+
+	case RTU_SERVER_TRANSPORT:
+		// open the serial device
+		ms.serialPort, err	= openSerialPort(ms.conf.URL, ms.conf.Speed,
+							  ms.conf.DataBits, ms.conf.Parity,
+							  ms.conf.StopBits)
+		if err != nil {
+			return
+		}
+
+		// serve the single serial link in a goroutine
+		go ms.handleRTUClient(ms.serialPort)
+
+	case RTU_SERVER_OVER_TCP_TRANSPORT:
+		// bind to a TCP socket: framing is still RTU (slave id + PDU + CRC),
+		// as emitted by cheap TCP-to-serial bridges
+		ms.tcpListener, err	= net.Listen("tcp", ms.conf.URL)
+		if err != nil {
+			return
+		}
+
+		// accept client connections in a goroutine
+		go ms.acceptTCPClients()
+
 	default:
 		err = ErrConfigurationError
 		return
@@ -192,14 +427,21 @@ func (ms *ModbusServer) Stop() (err error) {
 
 	ms.started = false
 
-	if ms.transportType == TCP_TRANSPORT {
-		// close the server socket if we're listening over TCP
+	switch ms.transportType {
+	case TCP_TRANSPORT, TCP_TLS_TRANSPORT, RTU_SERVER_OVER_TCP_TRANSPORT:
+		// close the server socket if we're listening over TCP (with or
+		// without TLS, and whether framed as MBAP or RTU)
 		err	= ms.tcpListener.Close()
 
 		// close all active TCP clients
 		for _, sock := range ms.tcpClients{
 			sock.Close()
 		}
+
+	case RTU_SERVER_TRANSPORT:
+		// close the serial device, unblocking the pending read in
+		// handleRTUClient()
+		err	= ms.serialPort.Close()
 	}
 
 	return
@@ -254,14 +496,132 @@ func (ms *ModbusServer) acceptTCPClients() {
 // out, or an unrecoverable error happened), the TCP socket is closed and removed
 // from the list of active client connections.
 func (ms *ModbusServer) handleTCPClient(sock net.Conn) {
-	var tt	*tcpTransport
+	var tt		*tcpTransport
+	var hc		HandlerContext
+	var cancel	context.CancelFunc
+
+	hc.ClientAddr		= sock.RemoteAddr()
+	hc.Context, cancel	= context.WithCancel(context.Background())
+	// the connection's context is cancelled once the transport loop
+	// returns (the pipelined loop also cancels the requests it still has in
+	// flight as soon as it stops reading from the client)
+	defer cancel()
+
+	// if this is a TLS listener, complete the handshake up front so that
+	// handshake failures (bad cert, missing client cert under mTLS, version
+	// mismatch...) are caught and logged here rather than surfacing as an
+	// opaque read error from the first Modbus request
+	if tlsSock, ok := sock.(*tls.Conn); ok {
+		// bound the handshake so a client that never sends a ClientHello
+		// can't pin this connection slot forever
+		tlsSock.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		if err := tlsSock.Handshake(); err != nil {
+			ms.logger.Warningf("TLS handshake with %v failed: %v",
+					    hc.ClientAddr, err)
+			ms.removeTCPClient(sock)
+			sock.Close()
+			return
+		}
+		tlsSock.SetDeadline(time.Time{})
+
+		hc.TLSRole	= ms.deriveTLSRole(tlsSock)
+		if state := tlsSock.ConnectionState(); len(state.PeerCertificates) > 0 {
+			hc.TLSPeerCert	= state.PeerCertificates[0]
+		}
+	}
+
+	ms.onAccept(hc.Context)
+	if ms.conf.Metrics != nil {
+		ms.conf.Metrics.connectionOpened()
+	}
+
+	switch {
+	case ms.transportType == RTU_SERVER_OVER_TCP_TRANSPORT:
+		// frame this connection as Modbus RTU rather than MBAP
+		ms.handleTransport(newServerRTUTransport(sock, 0, ms.conf.Timeout), &hc)
+
+	case ms.conf.MaxInFlightPerClient > 1:
+		// pipeline up to MaxInFlightPerClient requests concurrently,
+		// correlating responses by MBAP transaction ID
+		ms.handleTransportPipelined(sock, &hc)
 
-	// create a new transport
-	tt = newTCPTransport(sock, ms.conf.Timeout)
+	default:
+		// create a new MBAP transport, strictly serial
+		tt = newTCPTransport(sock, ms.conf.Timeout)
+		ms.handleTransport(tt, &hc)
+	}
 
-	ms.handleTransport(tt)
+	if ms.conf.Metrics != nil {
+		ms.conf.Metrics.connectionClosed()
+	}
+	ms.onClose(hc.Context)
 
 	// once done, remove our connection from the list of active client conns
+	ms.removeTCPClient(sock)
+
+	// close the connection
+	sock.Close()
+
+	return
+}
+
+// Handles the single serial link of an RTU listener. Unlike TCP transports,
+// there is only ever one "client" for the lifetime of the server, since the
+// link itself is point-to-multipoint at the electrical level (many slaves,
+// one shared bus) rather than the server accepting distinct connections.
+func (ms *ModbusServer) handleRTUClient(port io.ReadWriteCloser) {
+	var hc		HandlerContext
+	var cancel	context.CancelFunc
+
+	hc.Context, cancel	= context.WithCancel(context.Background())
+	defer cancel()
+
+	ms.onAccept(hc.Context)
+	if ms.conf.Metrics != nil {
+		ms.conf.Metrics.connectionOpened()
+	}
+
+	ms.handleTransport(newServerRTUTransport(port, ms.conf.Speed, ms.conf.Timeout), &hc)
+
+	if ms.conf.Metrics != nil {
+		ms.conf.Metrics.connectionClosed()
+	}
+	ms.onClose(hc.Context)
+
+	return
+}
+
+// onAccept invokes the user-provided OnAccept hook, if any.
+func (ms *ModbusServer) onAccept(ctx context.Context) {
+	if ms.conf.OnAccept != nil {
+		ms.conf.OnAccept(ctx)
+	}
+}
+
+// onClose invokes the user-provided OnClose hook, if any.
+func (ms *ModbusServer) onClose(ctx context.Context) {
+	if ms.conf.OnClose != nil {
+		ms.conf.OnClose(ctx)
+	}
+}
+
+// onRequest invokes the user-provided OnRequest hook, if any.
+func (ms *ModbusServer) onRequest(ctx context.Context, fc uint8, addr uint16, quantity uint16) {
+	if ms.conf.OnRequest != nil {
+		ms.conf.OnRequest(ctx, fc, addr, quantity)
+	}
+}
+
+// onResponse invokes the user-provided OnResponse hook, if any.
+func (ms *ModbusServer) onResponse(ctx context.Context, fc uint8, err error, elapsed time.Duration) {
+	if ms.conf.OnResponse != nil {
+		ms.conf.OnResponse(ctx, fc, err, elapsed)
+	}
+}
+
+// removeTCPClient removes sock from the list of active client connections, if
+// present.
+func (ms *ModbusServer) removeTCPClient(sock net.Conn) {
 	ms.lock.Lock()
 	for i := range ms.tcpClients {
 		if ms.tcpClients[i] == sock {
@@ -272,364 +632,481 @@ func (ms *ModbusServer) handleTCPClient(sock net.Conn) {
 	}
 	ms.lock.Unlock()
 
-	// close the connection
-	sock.Close()
-
 	return
 }
 
+// callHandleCoils invokes the HandleCoilsCtx method of the user-provided
+// handler if it implements RequestHandlerCtx, falling back to the plain
+// HandleCoils method otherwise.
+func (ms *ModbusServer) callHandleCoils(hc *HandlerContext, unitId uint8, addr uint16,
+	quantity uint16, isWrite bool, args []bool) (res []bool, err error) {
+	if ms.handlerCtx != nil {
+		return ms.handlerCtx.HandleCoilsCtx(hc, unitId, addr, quantity, isWrite, args)
+	}
+	return ms.handler.HandleCoils(unitId, addr, quantity, isWrite, args)
+}
+
+// callHandleDiscreteInputs invokes the HandleDiscreteInputsCtx method of the
+// user-provided handler if it implements RequestHandlerCtx, falling back to
+// the plain HandleDiscreteInputs method otherwise.
+func (ms *ModbusServer) callHandleDiscreteInputs(hc *HandlerContext, unitId uint8,
+	addr uint16, quantity uint16) (res []bool, err error) {
+	if ms.handlerCtx != nil {
+		return ms.handlerCtx.HandleDiscreteInputsCtx(hc, unitId, addr, quantity)
+	}
+	return ms.handler.HandleDiscreteInputs(unitId, addr, quantity)
+}
+
+// callHandleHoldingRegisters invokes the HandleHoldingRegistersCtx method of
+// the user-provided handler if it implements RequestHandlerCtx, falling back
+// to the plain HandleHoldingRegisters method otherwise.
+func (ms *ModbusServer) callHandleHoldingRegisters(hc *HandlerContext, unitId uint8,
+	addr uint16, quantity uint16, isWrite bool, args []uint16) (res []uint16, err error) {
+	if ms.handlerCtx != nil {
+		return ms.handlerCtx.HandleHoldingRegistersCtx(hc, unitId, addr, quantity, isWrite, args)
+	}
+	return ms.handler.HandleHoldingRegisters(unitId, addr, quantity, isWrite, args)
+}
+
+// callHandleInputRegisters invokes the HandleInputRegistersCtx method of the
+// user-provided handler if it implements RequestHandlerCtx, falling back to
+// the plain HandleInputRegisters method otherwise.
+func (ms *ModbusServer) callHandleInputRegisters(hc *HandlerContext, unitId uint8,
+	addr uint16, quantity uint16) (res []uint16, err error) {
+	if ms.handlerCtx != nil {
+		return ms.handlerCtx.HandleInputRegistersCtx(hc, unitId, addr, quantity)
+	}
+	return ms.handler.HandleInputRegisters(unitId, addr, quantity)
+}
+
 // For each request read from the transport, performs decoding and validation,
 // calls the user-provided handler, then encodes and writes the response
 // to the transport.
-func (ms *ModbusServer) handleTransport(t transport) {
-	var req		*pdu
-	var res		*pdu
-	var err		error
-	var addr	uint16
-	var quantity	uint16
 
-	for {
-		req, err = t.ReadRequest()
+// peekAddrQuantity performs a best-effort decode of the base address and
+// quantity fields carried by req, without invoking any handler, so that
+// ms.onRequest can be fired once the request has been decoded but before
+// dispatchRequest invokes the handler. Function codes whose address is not
+// decoded here (read FIFO queue, file record and device identification
+// requests) return (0, 0); mask write register requests return their
+// reference address with a quantity of 0.
+func peekAddrQuantity(req *pdu) (addr uint16, quantity uint16) {
+	switch req.functionCode {
+	case FC_READ_COILS, FC_READ_DISCRETE_INPUTS, FC_WRITE_MULTIPLE_COILS,
+	     FC_READ_HOLDING_REGISTERS, FC_READ_INPUT_REGISTERS, FC_WRITE_MULTIPLE_REGISTERS,
+	     FC_READ_WRITE_MULTIPLE_REGISTERS:
+		if len(req.payload) >= 4 {
+			addr		= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
+			quantity	= bytesToUint16(BIG_ENDIAN, req.payload[2:4])
+		}
+
+	case FC_WRITE_SINGLE_COIL, FC_WRITE_SINGLE_REGISTER:
+		if len(req.payload) >= 2 {
+			addr		= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
+			quantity	= 1
+		}
+
+	case FC_MASK_WRITE_REGISTER:
+		if len(req.payload) >= 2 {
+			addr		= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
+		}
+	}
+
+	return
+}
+
+// dispatchRequest decodes, validates and dispatches a single request to the
+// user-provided handler, returning the response PDU (or protocol/modbus error)
+// to send back. It holds no per-connection state, so it is safe to call
+// concurrently for distinct requests (see handleTransportPipelined).
+func (ms *ModbusServer) dispatchRequest(req *pdu, hc *HandlerContext) (res *pdu, addr uint16, quantity uint16, err error) {
+	switch req.functionCode {
+	case FC_READ_COILS, FC_READ_DISCRETE_INPUTS:
+		var coils	[]bool
+		var resCount	int
+
+		if len(req.payload) != 4 {
+			err = ErrProtocolError
+			break
+		}
+
+		// decode address and quantity fields
+		addr		= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
+		quantity	= bytesToUint16(BIG_ENDIAN, req.payload[2:4])
+
+		// ensure the reply never exceeds the maximum PDU length and we
+		// never read past 0xffff
+		if quantity > 2000 || quantity == 0 {
+			err	= ErrProtocolError
+			break
+		}
+		if uint32(addr) + uint32(quantity) - 1 > 0xffff {
+			err	= ErrIllegalDataAddress
+			break
+		}
+
+		// invoke the appropriate handler
+		if req.functionCode == FC_READ_COILS {
+			coils, err	= ms.callHandleCoils(hc,
+				req.unitId,
+				addr, quantity,
+				false, nil)
+		} else {
+			coils, err	= ms.callHandleDiscreteInputs(hc,
+				req.unitId, addr, quantity)
+		}
+		resCount	= len(coils)
+
+		// make sure the handler returned the expected number of items
+		if err == nil && resCount != int(quantity) {
+			ms.logger.Errorf("handler returned %v bools, " +
+				         "expected %v", resCount, quantity)
+			err = ErrServerDeviceFailure
+			break
+		}
+
 		if err != nil {
-			return
+			break
 		}
 
-		switch req.functionCode {
-		case FC_READ_COILS, FC_READ_DISCRETE_INPUTS:
-			var coils	[]bool
-			var resCount	int
+		// assemble a response PDU
+		res = &pdu{
+			unitId:		req.unitId,
+			functionCode:	req.functionCode,
+			payload:	[]byte{0},
+		}
 
-			if len(req.payload) != 4 {
-				err = ErrProtocolError
-				break
-			}
+		// byte count (1 byte for 8 coils)
+		res.payload[0]	= uint8(resCount / 8)
+		if resCount % 8 != 0 {
+			res.payload[0]++
+		}
 
-			// decode address and quantity fields
-			addr		= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
-			quantity	= bytesToUint16(BIG_ENDIAN, req.payload[2:4])
+		// coil values
+		res.payload	= append(res.payload, encodeBools(coils)...)
 
-			// ensure the reply never exceeds the maximum PDU length and we
-			// never read past 0xffff
-			if quantity > 2000 || quantity == 0 {
-				err	= ErrProtocolError
-				break
-			}
-			if uint32(addr) + uint32(quantity) - 1 > 0xffff {
-				err	= ErrIllegalDataAddress
-				break
-			}
+	case FC_WRITE_SINGLE_COIL:
+		if len(req.payload) != 4 {
+			err = ErrProtocolError
+			break
+		}
 
-			// invoke the appropriate handler
-			if req.functionCode == FC_READ_COILS {
-				coils, err	= ms.handler.HandleCoils(
-					req.unitId,
-					addr, quantity,
-					false, nil)
-			} else {
-				coils, err	= ms.handler.HandleDiscreteInputs(
-					req.unitId, addr, quantity)
-			}
-			resCount	= len(coils)
-
-			// make sure the handler returned the expected number of items
-			if err == nil && resCount != int(quantity) {
-				ms.logger.Errorf("handler returned %v bools, " +
-					         "expected %v", resCount, quantity)
-				err = ErrServerDeviceFailure
-				break
-			}
+		// decode the address field
+		addr	= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
 
-			if err != nil {
-				break
-			}
+		// validate the value field (should be either 0xff00 or 0x0000)
+		if ((req.payload[2] != 0xff && req.payload[2] != 0x00) ||
+		    req.payload[3] != 0x00) {
+			err = ErrProtocolError
+			break
+		}
 
-			// assemble a response PDU
-			res = &pdu{
-				unitId:		req.unitId,
-				functionCode:	req.functionCode,
-				payload:	[]byte{0},
-			}
+		// invoke the coil handler
+		_, err	= ms.callHandleCoils(hc,
+			req.unitId,
+			addr, 1,	// quantity is 1
+			true,		// this is a write request
+			[]bool{(req.payload[2] == 0xff)})
 
-			// byte count (1 byte for 8 coils)
-			res.payload[0]	= uint8(resCount / 8)
-			if resCount % 8 != 0 {
-				res.payload[0]++
-			}
+		if err != nil {
+			break
+		}
 
-			// coil values
-			res.payload	= append(res.payload, encodeBools(coils)...)
+		// assemble a response PDU
+		res = &pdu{
+			unitId:		req.unitId,
+			functionCode:	req.functionCode,
+		}
 
-		case FC_WRITE_SINGLE_COIL:
-			if len(req.payload) != 4 {
-				err = ErrProtocolError
-				break
-			}
+		// echo the address and value in the response
+		res.payload	= append(res.payload,
+					 uint16ToBytes(BIG_ENDIAN, addr)...)
+		res.payload	= append(res.payload,
+					 req.payload[2], req.payload[3])
 
-			// decode the address field
-			addr	= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
+	case FC_WRITE_MULTIPLE_COILS:
+		var expectedLen	int
 
-			// validate the value field (should be either 0xff00 or 0x0000)
-			if ((req.payload[2] != 0xff && req.payload[2] != 0x00) ||
-			    req.payload[3] != 0x00) {
-				err = ErrProtocolError
-				break
-			}
+		if len(req.payload) < 6 {
+			err = ErrProtocolError
+			break
+		}
 
-			// invoke the coil handler
-			_, err	= ms.handler.HandleCoils(
-				req.unitId,
-				addr, 1,	// quantity is 1
-				true,		// this is a write request
-				[]bool{(req.payload[2] == 0xff)})
+		// decode address and quantity fields
+		addr		= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
+		quantity	= bytesToUint16(BIG_ENDIAN, req.payload[2:4])
 
-			if err != nil {
-				break
-			}
+		// ensure the reply never exceeds the maximum PDU length and we
+		// never read past 0xffff
+		if quantity > 0x7b0 || quantity == 0 {
+			err	= ErrProtocolError
+			break
+		}
+		if uint32(addr) + uint32(quantity) - 1 > 0xffff {
+			err	= ErrIllegalDataAddress
+			break
+		}
 
-			// assemble a response PDU
-			res = &pdu{
-				unitId:		req.unitId,
-				functionCode:	req.functionCode,
-			}
+		// validate the byte count field (1 byte for 8 coils)
+		expectedLen	= int(quantity) / 8
+		if quantity % 8 != 0 {
+			expectedLen++
+		}
 
-			// echo the address and value in the response
-			res.payload	= append(res.payload,
-						 uint16ToBytes(BIG_ENDIAN, addr)...)
-			res.payload	= append(res.payload,
-						 req.payload[2], req.payload[3])
+		if req.payload[4] != uint8(expectedLen) {
+			err	= ErrProtocolError
+			break
+		}
 
-		case FC_WRITE_MULTIPLE_COILS:
-			var expectedLen	int
+		// make sure we have enough bytes
+		if len(req.payload) - 5 != expectedLen {
+			err	= ErrProtocolError
+			break
+		}
 
-			if len(req.payload) < 6 {
-				err = ErrProtocolError
-				break
-			}
+		// invoke the coil handler
+		_, err		= ms.callHandleCoils(hc,
+			req.unitId,
+			addr, quantity,
+			true,		// this is a write request
+			decodeBools(quantity, req.payload[5:]))
 
-			// decode address and quantity fields
-			addr		= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
-			quantity	= bytesToUint16(BIG_ENDIAN, req.payload[2:4])
+		if err != nil {
+			break
+		}
 
-			// ensure the reply never exceeds the maximum PDU length and we
-			// never read past 0xffff
-			if quantity > 0x7b0 || quantity == 0 {
-				err	= ErrProtocolError
-				break
-			}
-			if uint32(addr) + uint32(quantity) - 1 > 0xffff {
-				err	= ErrIllegalDataAddress
-				break
-			}
+		// assemble a response PDU
+		res = &pdu{
+			unitId:		req.unitId,
+			functionCode:	req.functionCode,
+		}
 
-			// validate the byte count field (1 byte for 8 coils)
-			expectedLen	= int(quantity) / 8
-			if quantity % 8 != 0 {
-				expectedLen++
-			}
+		// echo the address and quantity in the response
+		res.payload	= append(res.payload,
+					 uint16ToBytes(BIG_ENDIAN, addr)...)
+		res.payload	= append(res.payload,
+					 uint16ToBytes(BIG_ENDIAN, quantity)...)
 
-			if req.payload[4] != uint8(expectedLen) {
-				err	= ErrProtocolError
-				break
-			}
+	case FC_READ_HOLDING_REGISTERS, FC_READ_INPUT_REGISTERS:
+		var regs	[]uint16
+		var resCount	int
 
-			// make sure we have enough bytes
-			if len(req.payload) - 5 != expectedLen {
-				err	= ErrProtocolError
-				break
-			}
+		if len(req.payload) != 4 {
+			err = ErrProtocolError
+			break
+		}
+
+		// decode address and quantity fields
+		addr		= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
+		quantity	= bytesToUint16(BIG_ENDIAN, req.payload[2:4])
+
+		// ensure the reply never exceeds the maximum PDU length and we
+		// never read past 0xffff
+		if quantity > 0x007d || quantity == 0 {
+			err	= ErrProtocolError
+			break
+		}
+		if uint32(addr) + uint32(quantity) - 1 > 0xffff {
+			err	= ErrIllegalDataAddress
+			break
+		}
 
-			// invoke the coil handler
-			_, err		= ms.handler.HandleCoils(
+		// invoke the appropriate handler
+		if req.functionCode == FC_READ_HOLDING_REGISTERS {
+			regs, err	= ms.callHandleHoldingRegisters(hc,
 				req.unitId,
 				addr, quantity,
-				true,		// this is a write request
-				decodeBools(quantity, req.payload[5:]))
+				false, nil)
+		} else {
+			regs, err	= ms.callHandleInputRegisters(hc,
+				req.unitId, addr, quantity)
+		}
+		resCount	= len(regs)
 
-			if err != nil {
-				break
-			}
+		// make sure the handler returned the expected number of items
+		if err == nil && resCount != int(quantity) {
+			ms.logger.Errorf("handler returned %v 16-bit values, " +
+				         "expected %v", resCount, quantity)
+			err = ErrServerDeviceFailure
+			break
+		}
 
-			// assemble a response PDU
-			res = &pdu{
-				unitId:		req.unitId,
-				functionCode:	req.functionCode,
-			}
+		if err != nil {
+			break
+		}
 
-			// echo the address and quantity in the response
-			res.payload	= append(res.payload,
-						 uint16ToBytes(BIG_ENDIAN, addr)...)
-			res.payload	= append(res.payload,
-						 uint16ToBytes(BIG_ENDIAN, quantity)...)
+		// assemble a response PDU
+		res = &pdu{
+			unitId:		req.unitId,
+			functionCode:	req.functionCode,
+			payload:	[]byte{0},
+		}
 
-		case FC_READ_HOLDING_REGISTERS, FC_READ_INPUT_REGISTERS:
-			var regs	[]uint16
-			var resCount	int
+		// byte count (2 bytes per register)
+		res.payload[0]	= uint8(resCount * 2)
 
-			if len(req.payload) != 4 {
-				err = ErrProtocolError
-				break
-			}
+		// register values
+		res.payload	= append(res.payload,
+					 uint16sToBytes(BIG_ENDIAN, regs)...)
 
-			// decode address and quantity fields
-			addr		= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
-			quantity	= bytesToUint16(BIG_ENDIAN, req.payload[2:4])
+	case FC_WRITE_SINGLE_REGISTER:
+		var value	uint16
 
-			// ensure the reply never exceeds the maximum PDU length and we
-			// never read past 0xffff
-			if quantity > 0x007d || quantity == 0 {
-				err	= ErrProtocolError
-				break
-			}
-			if uint32(addr) + uint32(quantity) - 1 > 0xffff {
-				err	= ErrIllegalDataAddress
-				break
-			}
+		if len(req.payload) != 4 {
+			err = ErrProtocolError
+			break
+		}
 
-			// invoke the appropriate handler
-			if req.functionCode == FC_READ_HOLDING_REGISTERS {
-				regs, err	= ms.handler.HandleHoldingRegisters(
-					req.unitId,
-					addr, quantity,
-					false, nil)
-			} else {
-				regs, err	= ms.handler.HandleInputRegisters(
-					req.unitId, addr, quantity)
-			}
-			resCount	= len(regs)
-
-			// make sure the handler returned the expected number of items
-			if err == nil && resCount != int(quantity) {
-				ms.logger.Errorf("handler returned %v 16-bit values, " +
-					         "expected %v", resCount, quantity)
-				err = ErrServerDeviceFailure
-				break
-			}
+		// decode address and value fields
+		addr	= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
+		value	= bytesToUint16(BIG_ENDIAN, req.payload[2:4])
 
-			if err != nil {
-				break
-			}
+		// invoke the handler
+		_, err	= ms.callHandleHoldingRegisters(hc,
+			req.unitId,
+			addr, 1,	// quantity is 1
+			true,		// this is a write request
+			[]uint16{value})
 
-			// assemble a response PDU
-			res = &pdu{
-				unitId:		req.unitId,
-				functionCode:	req.functionCode,
-				payload:	[]byte{0},
-			}
+		if err != nil {
+			break
+		}
 
-			// byte count (2 bytes per register)
-			res.payload[0]	= uint8(resCount * 2)
+		// assemble a response PDU
+		res = &pdu{
+			unitId:		req.unitId,
+			functionCode:	req.functionCode,
+		}
 
-			// register values
-			res.payload	= append(res.payload,
-						 uint16sToBytes(BIG_ENDIAN, regs)...)
+		// echo the address and value in the response
+		res.payload	= append(res.payload,
+					 uint16ToBytes(BIG_ENDIAN, addr)...)
+		res.payload	= append(res.payload,
+					 uint16ToBytes(BIG_ENDIAN, value)...)
 
-		case FC_WRITE_SINGLE_REGISTER:
-			var value	uint16
+	case FC_WRITE_MULTIPLE_REGISTERS:
+		var expectedLen	int
 
-			if len(req.payload) != 4 {
-				err = ErrProtocolError
-				break
-			}
+		if len(req.payload) < 6 {
+			err = ErrProtocolError
+			break
+		}
 
-			// decode address and value fields
-			addr	= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
-			value	= bytesToUint16(BIG_ENDIAN, req.payload[2:4])
+		// decode address and quantity fields
+		addr		= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
+		quantity	= bytesToUint16(BIG_ENDIAN, req.payload[2:4])
 
-			// invoke the handler
-			_, err	= ms.handler.HandleHoldingRegisters(
-				req.unitId,
-				addr, 1,	// quantity is 1
-				true,		// this is a write request
-				[]uint16{value})
+		// ensure the reply never exceeds the maximum PDU length and we
+		// never read past 0xffff
+		if quantity > 0x007b || quantity == 0 {
+			err	= ErrProtocolError
+			break
+		}
+		if uint32(addr) + uint32(quantity) - 1 > 0xffff {
+			err	= ErrIllegalDataAddress
+			break
+		}
 
-			if err != nil {
-				break
-			}
+		// validate the byte count field (2 bytes per register)
+		expectedLen	= int(quantity) * 2
 
-			// assemble a response PDU
-			res = &pdu{
-				unitId:		req.unitId,
-				functionCode:	req.functionCode,
-			}
+		if req.payload[4] != uint8(expectedLen) {
+			err	= ErrProtocolError
+			break
+		}
 
-			// echo the address and value in the response
-			res.payload	= append(res.payload,
-						 uint16ToBytes(BIG_ENDIAN, addr)...)
-			res.payload	= append(res.payload,
-						 uint16ToBytes(BIG_ENDIAN, value)...)
+		// make sure we have enough bytes
+		if len(req.payload) - 5 != expectedLen {
+			err	= ErrProtocolError
+			break
+		}
 
-		case FC_WRITE_MULTIPLE_REGISTERS:
-			var expectedLen	int
+		// invoke the holding register handler
+		_, err		= ms.callHandleHoldingRegisters(hc,
+			req.unitId,
+			addr, quantity,
+			true,		// this is a write request
+			bytesToUint16s(BIG_ENDIAN, req.payload[5:]))
 
-			if len(req.payload) < 6 {
-				err = ErrProtocolError
-				break
-			}
+		if err != nil {
+			break
+		}
 
-			// decode address and quantity fields
-			addr		= bytesToUint16(BIG_ENDIAN, req.payload[0:2])
-			quantity	= bytesToUint16(BIG_ENDIAN, req.payload[2:4])
+		// assemble a response PDU
+		res = &pdu{
+			unitId:		req.unitId,
+			functionCode:	req.functionCode,
+		}
 
-			// ensure the reply never exceeds the maximum PDU length and we
-			// never read past 0xffff
-			if quantity > 0x007b || quantity == 0 {
-				err	= ErrProtocolError
-				break
-			}
-			if uint32(addr) + uint32(quantity) - 1 > 0xffff {
-				err	= ErrIllegalDataAddress
-				break
-			}
+		// echo the address and quantity in the response
+		res.payload	= append(res.payload,
+					 uint16ToBytes(BIG_ENDIAN, addr)...)
+		res.payload	= append(res.payload,
+					 uint16ToBytes(BIG_ENDIAN, quantity)...)
 
-			// validate the byte count field (2 bytes per register)
-			expectedLen	= int(quantity) * 2
+	case FC_MASK_WRITE_REGISTER:
+		res, err = ms.handleMaskWriteRegister(req, hc)
 
-			if req.payload[4] != uint8(expectedLen) {
-				err	= ErrProtocolError
-				break
-			}
+	case FC_READ_WRITE_MULTIPLE_REGISTERS:
+		res, err = ms.handleReadWriteMultipleRegisters(req, hc)
 
-			// make sure we have enough bytes
-			if len(req.payload) - 5 != expectedLen {
-				err	= ErrProtocolError
-				break
-			}
+	case FC_READ_FIFO_QUEUE:
+		res, err = ms.handleReadFIFOQueue(req, hc)
 
-			// invoke the holding register handler
-			_, err		= ms.handler.HandleHoldingRegisters(
-				req.unitId,
-				addr, quantity,
-				true,		// this is a write request
-				bytesToUint16s(BIG_ENDIAN, req.payload[5:]))
+	case FC_READ_FILE_RECORD, FC_WRITE_FILE_RECORD:
+		res, err = ms.handleFileRecord(req, hc)
 
-			if err != nil {
-				break
-			}
+	case FC_ENCAPSULATED_INTERFACE_TRANSPORT:
+		res, err = ms.handleEncapsulatedInterfaceTransport(req, hc)
 
-			// assemble a response PDU
-			res = &pdu{
-				unitId:		req.unitId,
-				functionCode:	req.functionCode,
-			}
+	default:
+		// the server does not know how to handle this function code,
+		// and no handler extension applies to it either
+		res = illegalFunctionResponse(req)
+	}
 
-			// echo the address and quantity in the response
-			res.payload	= append(res.payload,
-						 uint16ToBytes(BIG_ENDIAN, addr)...)
-			res.payload	= append(res.payload,
-						 uint16ToBytes(BIG_ENDIAN, quantity)...)
-
-		default:
-			res = &pdu{
-				// reply with the request target unit ID
-				unitId:		req.unitId,
-				// set the error bit
-				functionCode:	(0x80 | req.functionCode),
-				// set the exception code to illegal function to indicate that
-				// the server does not know how to handle this function code.
-				payload:	[]byte{EX_ILLEGAL_FUNCTION},
-			}
+	return
+}
+
+func (ms *ModbusServer) handleTransport(t transport, hc *HandlerContext) {
+	var req		*pdu
+	var res		*pdu
+	var err		error
+	var addr	uint16
+	var quantity	uint16
+	var reqStart	time.Time
+	var baseCtx	context.Context
+
+	baseCtx	= hc.Context
+	if baseCtx == nil {
+		baseCtx = context.Background()
+	}
+
+	for {
+		req, err = t.ReadRequest()
+		if err != nil {
+			return
+		}
+
+		reqStart	= time.Now()
+		hc.UnitId	= req.unitId
+
+		// bound how long this single request may take to process to
+		// ServerConfiguration.Timeout, and make sure the per-request
+		// context (and any deadline timer backing it) is released once
+		// the request has been served, regardless of outcome
+		var cancel	context.CancelFunc
+		if ms.conf.Timeout > 0 {
+			hc.Context, cancel = context.WithTimeout(baseCtx, ms.conf.Timeout)
+		} else {
+			hc.Context, cancel = context.WithCancel(baseCtx)
 		}
 
+		addr, quantity = peekAddrQuantity(req)
+		ms.onRequest(hc.Context, req.functionCode, addr, quantity)
+
+		res, addr, quantity, err = ms.dispatchRequest(req, hc)
+
 		// if there was no error processing the request but the response is nil
 		// (which should never happen), emit a server failure exception code
 		// and log an error
@@ -644,6 +1121,8 @@ func (ms *ModbusServer) handleTransport(t transport) {
 		if err != nil {
 			if err == ErrProtocolError {
 				ms.logger.Warningf("protocol error, closing link")
+				ms.onResponse(hc.Context, req.functionCode, err, time.Since(reqStart))
+				cancel()
 				t.Close()
 				return
 			} else {
@@ -655,12 +1134,19 @@ func (ms *ModbusServer) handleTransport(t transport) {
 			}
 		}
 
+		if ms.conf.Metrics != nil {
+			ms.conf.Metrics.requestServed(req.functionCode, err, time.Since(reqStart))
+		}
+		ms.onResponse(hc.Context, req.functionCode, err, time.Since(reqStart))
+
 		// write the response to the transport
 		err	= t.WriteResponse(res)
 		if err != nil {
 			ms.logger.Warningf("failed to write response: %v", err)
 		}
 
+		cancel()
+
 		// avoid holding on to stale data
 		req	= nil
 		res	= nil
@@ -0,0 +1,146 @@
+package modbus
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestRequestResponseHooksAndMetricsFire verifies that OnRequest and
+// OnResponse are invoked with the decoded function code/address/quantity for
+// a served request, and that Metrics observes the same request.
+func TestRequestResponseHooksAndMetricsFire(t *testing.T) {
+	handler := newMemoryHandler()
+	handler.holdingRegs[5] = 0x2a
+
+	var lock		sync.Mutex
+	var sawRequest		bool
+	var sawResponse		bool
+	var reqFC, resFC	uint8
+	var reqAddr, reqQty	uint16
+	var resErr		error
+
+	metrics := NewServerMetrics()
+
+	addr := freeTCPAddr(t)
+	ms, err := NewServer(&ServerConfiguration{
+		URL:     addr,
+		Timeout: 2 * time.Second,
+		Metrics: metrics,
+		OnRequest: func(ctx context.Context, fc uint8, a uint16, q uint16) {
+			lock.Lock()
+			defer lock.Unlock()
+			sawRequest	= true
+			reqFC		= fc
+			reqAddr		= a
+			reqQty		= q
+		},
+		OnResponse: func(ctx context.Context, fc uint8, err error, elapsed time.Duration) {
+			lock.Lock()
+			defer lock.Unlock()
+			sawResponse	= true
+			resFC		= fc
+			resErr		= err
+		},
+	}, handler)
+	if err != nil {
+		t.Fatalf("NewServer() failed: %v", err)
+	}
+	if err := ms.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer ms.Stop()
+
+	client, err := NewClient(&ClientConfiguration{URL: addr, Timeout: 2 * time.Second})
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	if err := client.Open(); err != nil {
+		t.Fatalf("client Open() failed: %v", err)
+	}
+	defer client.Close()
+
+	regs, err := client.ReadHoldingRegisters(5, 1)
+	if err != nil {
+		t.Fatalf("ReadHoldingRegisters() failed: %v", err)
+	}
+	if len(regs) != 1 || regs[0] != 0x2a {
+		t.Fatalf("unexpected register value: %v", regs)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if !sawRequest {
+		t.Errorf("OnRequest was never invoked")
+	}
+	if reqFC != FC_READ_HOLDING_REGISTERS || reqAddr != 5 || reqQty != 1 {
+		t.Errorf("OnRequest got fc=0x%02x addr=%v quantity=%v, want fc=0x%02x addr=5 quantity=1",
+			reqFC, reqAddr, reqQty, FC_READ_HOLDING_REGISTERS)
+	}
+
+	if !sawResponse {
+		t.Errorf("OnResponse was never invoked")
+	}
+	if resFC != FC_READ_HOLDING_REGISTERS || resErr != nil {
+		t.Errorf("OnResponse got fc=0x%02x err=%v, want fc=0x%02x err=nil",
+			resFC, resErr, FC_READ_HOLDING_REGISTERS)
+	}
+
+	if got := metrics.RequestCount(FC_READ_HOLDING_REGISTERS); got != 1 {
+		t.Errorf("Metrics.RequestCount(FC_READ_HOLDING_REGISTERS) = %v, want 1", got)
+	}
+	if got := metrics.ExceptionCount(FC_READ_HOLDING_REGISTERS); got != 0 {
+		t.Errorf("Metrics.ExceptionCount(FC_READ_HOLDING_REGISTERS) = %v, want 0", got)
+	}
+}
+
+// TestRequestHookFiresInPipelinedPath verifies that OnRequest is also
+// invoked when the connection is served by handleTransportPipelined
+// (ServerConfiguration.MaxInFlightPerClient > 1).
+func TestRequestHookFiresInPipelinedPath(t *testing.T) {
+	handler := newMemoryHandler()
+	handler.holdingRegs[7] = 0x55
+
+	var lock	sync.Mutex
+	var fcsSeen	[]uint8
+
+	addr := freeTCPAddr(t)
+	ms, err := NewServer(&ServerConfiguration{
+		URL:                  addr,
+		Timeout:              2 * time.Second,
+		MaxInFlightPerClient: 4,
+		OnRequest: func(ctx context.Context, fc uint8, a uint16, q uint16) {
+			lock.Lock()
+			defer lock.Unlock()
+			fcsSeen = append(fcsSeen, fc)
+		},
+	}, handler)
+	if err != nil {
+		t.Fatalf("NewServer() failed: %v", err)
+	}
+	if err := ms.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer ms.Stop()
+
+	client, err := NewClient(&ClientConfiguration{URL: addr, Timeout: 2 * time.Second})
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	if err := client.Open(); err != nil {
+		t.Fatalf("client Open() failed: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.ReadHoldingRegisters(7, 1); err != nil {
+		t.Fatalf("ReadHoldingRegisters() failed: %v", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(fcsSeen) != 1 || fcsSeen[0] != FC_READ_HOLDING_REGISTERS {
+		t.Errorf("OnRequest was not invoked as expected in the pipelined path: %v", fcsSeen)
+	}
+}
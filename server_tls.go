@@ -0,0 +1,96 @@
+package modbus
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"io/ioutil"
+	"time"
+)
+
+// TCP_TLS_TRANSPORT identifies a server listening for Modbus/TCP requests
+// over a TLS-wrapped socket (MBAPS), as opposed to the plain TCP_TRANSPORT.
+const (
+	TCP_TLS_TRANSPORT	transportType	= TCP_TRANSPORT + 1
+)
+
+// tlsHandshakeTimeout bounds how long a client has to complete the TLS
+// handshake after connecting, so that a client which never sends a
+// ClientHello cannot pin a connection slot forever.
+const tlsHandshakeTimeout time.Duration = 30 * time.Second
+
+// validateTLSConfig ensures a usable *tls.Config was provided for a
+// tcp+tls:///tcps:// listener and fills in a sane default minimum protocol
+// version if none was set.
+func (ms *ModbusServer) validateTLSConfig() (err error) {
+	if ms.conf.TLSConfig == nil {
+		err	= ErrConfigurationError
+		return
+	}
+
+	if len(ms.conf.TLSConfig.Certificates) == 0 && ms.conf.TLSConfig.GetCertificate == nil {
+		err	= ErrConfigurationError
+		return
+	}
+
+	if ms.conf.TLSConfig.MinVersion == 0 {
+		ms.conf.TLSConfig.MinVersion = tls.VersionTLS12
+	}
+
+	return
+}
+
+// deriveTLSRole extracts the authorized role of a TLS client from its peer
+// certificate chain, once the handshake has completed. If conf.TLSRoleOID is
+// set, the role is read from the first matching certificate extension;
+// otherwise, the certificate's Common Name is used. Returns an empty string
+// if the client presented no certificate (e.g. mTLS is not enforced).
+func (ms *ModbusServer) deriveTLSRole(tlsSock *tls.Conn) (role string) {
+	var state	tls.ConnectionState
+	var cert	*x509.Certificate
+
+	state	= tlsSock.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return
+	}
+	cert	= state.PeerCertificates[0]
+
+	if len(ms.conf.TLSRoleOID) > 0 {
+		for _, ext := range cert.Extensions {
+			if ext.Id.Equal(ms.conf.TLSRoleOID) {
+				var value	string
+
+				if _, err := asn1.Unmarshal(ext.Value, &value); err == nil {
+					role	= value
+				}
+				return
+			}
+		}
+		return
+	}
+
+	role	= cert.Subject.CommonName
+
+	return
+}
+
+// LoadCertPool loads a PEM-encoded bundle of one or more CA certificates from
+// caFilePath and returns an *x509.CertPool suitable for use as
+// ServerConfiguration.TLSConfig.ClientCAs (to authenticate clients under
+// mTLS) or as the RootCAs of a client-side *tls.Config.
+func LoadCertPool(caFilePath string) (pool *x509.CertPool, err error) {
+	var pemBytes	[]byte
+
+	pemBytes, err	= ioutil.ReadFile(caFilePath)
+	if err != nil {
+		return
+	}
+
+	pool	= x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemBytes) {
+		err	= ErrConfigurationError
+		return
+	}
+
+	return
+}
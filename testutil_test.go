@@ -0,0 +1,102 @@
+package modbus
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+// freeTCPAddr returns a "tcp://127.0.0.1:<port>" URL bound to an ephemeral
+// port that is free at the time of the call, for use as a ServerConfiguration
+// or ClientConfiguration URL in tests.
+func freeTCPAddr(t testing.TB) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to reserve a free port: %v", err)
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	l.Close()
+
+	return fmt.Sprintf("tcp://127.0.0.1:%d", addr.Port)
+}
+
+// memoryHandler is a minimal in-memory RequestHandler backed by plain maps,
+// used by integration tests that need a real handler on the other end of a
+// ModbusServer without pulling in any external dependency. Coil and holding
+// register requests (reads and writes) touching an address in exceptionAddrs
+// return ErrIllegalDataAddress, to exercise exception passthrough.
+type memoryHandler struct {
+	coils           map[uint16]bool
+	holdingRegs     map[uint16]uint16
+	exceptionAddrs  map[uint16]bool
+}
+
+func newMemoryHandler() *memoryHandler {
+	return &memoryHandler{
+		coils:          make(map[uint16]bool),
+		holdingRegs:    make(map[uint16]uint16),
+		exceptionAddrs: make(map[uint16]bool),
+	}
+}
+
+func (mh *memoryHandler) HandleCoils(unitId uint8, addr uint16, quantity uint16,
+	isWrite bool, args []bool) (res []bool, err error) {
+	for i := uint16(0); i < quantity; i++ {
+		if mh.exceptionAddrs[addr+i] {
+			err = ErrIllegalDataAddress
+			return
+		}
+	}
+
+	if isWrite {
+		for i, v := range args {
+			mh.coils[addr+uint16(i)] = v
+		}
+		return
+	}
+
+	res = make([]bool, quantity)
+	for i := range res {
+		res[i] = mh.coils[addr+uint16(i)]
+	}
+
+	return
+}
+
+func (mh *memoryHandler) HandleDiscreteInputs(unitId uint8, addr uint16,
+	quantity uint16) (res []bool, err error) {
+	res = make([]bool, quantity)
+	return
+}
+
+func (mh *memoryHandler) HandleHoldingRegisters(unitId uint8, addr uint16, quantity uint16,
+	isWrite bool, args []uint16) (res []uint16, err error) {
+	for i := uint16(0); i < quantity; i++ {
+		if mh.exceptionAddrs[addr+i] {
+			err = ErrIllegalDataAddress
+			return
+		}
+	}
+
+	if isWrite {
+		for i, v := range args {
+			mh.holdingRegs[addr+uint16(i)] = v
+		}
+		return
+	}
+
+	res = make([]uint16, quantity)
+	for i := range res {
+		res[i] = mh.holdingRegs[addr+uint16(i)]
+	}
+
+	return
+}
+
+func (mh *memoryHandler) HandleInputRegisters(unitId uint8, addr uint16,
+	quantity uint16) (res []uint16, err error) {
+	res = make([]uint16, quantity)
+	return
+}
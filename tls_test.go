@@ -0,0 +1,259 @@
+package modbus
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testCA bundles a self-signed CA keypair used to mint short-lived leaf
+// certificates for the TLS tests below.
+type testCA struct {
+	cert    *x509.Certificate
+	certDER []byte
+	key     *rsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate CA key: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to self-sign CA cert: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse CA cert: %v", err)
+	}
+
+	return &testCA{cert: cert, certDER: der, key: key}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// issue mints a leaf certificate for commonName, signed by ca, valid for both
+// server and client authentication.
+func (ca *testCA) issue(t *testing.T, commonName string) tls.Certificate {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate leaf key: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("failed to issue leaf cert for %q: %v", commonName, err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+}
+
+// startTLSServer starts a ModbusServer listening over tcp+tls:// with tlsConf
+// as its TLS configuration (Certificates/ClientCAs/ClientAuth are the caller's
+// responsibility), and returns its address and a stop function.
+func startTLSServer(t *testing.T, handler RequestHandler, tlsConf *tls.Config) (addr string, stop func()) {
+	t.Helper()
+
+	addr = freeTCPAddr(t)
+
+	ms, err := NewServer(&ServerConfiguration{
+		URL:       "tcp+tls://" + addr[len("tcp://"):],
+		Timeout:   time.Second,
+		TLSConfig: tlsConf,
+	}, handler)
+	if err != nil {
+		t.Fatalf("NewServer() failed: %v", err)
+	}
+
+	if err := ms.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+
+	return addr[len("tcp://"):], func() { ms.Stop() }
+}
+
+// TestTLSHandshakeFailureIsRejectedCleanly verifies that a client which fails
+// the TLS handshake (here, because it doesn't trust the server's CA) is
+// rejected without the server hanging or panicking.
+func TestTLSHandshakeFailureIsRejectedCleanly(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert := ca.issue(t, "modbus-server")
+
+	addr, stop := startTLSServer(t, newMemoryHandler(), &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+	})
+	defer stop()
+
+	// deliberately don't trust the server's CA: the handshake must fail
+	// client-side (and the server must close the connection, not hang).
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		RootCAs: x509.NewCertPool(),
+	})
+	if err == nil {
+		conn.Close()
+		t.Fatalf("expected handshake to fail against an untrusted CA, it succeeded")
+	}
+}
+
+// TestTLSCertlessClientRejectedUnderMTLS verifies that, when the server
+// requires a client certificate, a client presenting none is rejected.
+func TestTLSCertlessClientRejectedUnderMTLS(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert := ca.issue(t, "modbus-server")
+
+	addr, stop := startTLSServer(t, newMemoryHandler(), &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    ca.pool(),
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	defer stop()
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		RootCAs: ca.pool(),
+		// no Certificates set: this client presents no client certificate
+	})
+	if err != nil {
+		// some TLS stacks fail the handshake outright when no cert is
+		// presented to a server that requires one
+		return
+	}
+	defer conn.Close()
+
+	// others complete the handshake but the server then refuses to serve the
+	// connection; either way a subsequent request must not succeed
+	if _, err := conn.Write([]byte{0, 1, 0, 0, 0, 6, 1, 3, 0, 0, 0, 1}); err != nil {
+		return
+	}
+	buf := make([]byte, 16)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(buf); err == nil {
+		t.Fatalf("expected certless mTLS client to be rejected, got a response")
+	}
+}
+
+// TestTLSRoleBasedRejection verifies that ServerConfiguration.TLSRoleOID (or,
+// as here, the client certificate's Common Name) is correctly derived into
+// HandlerContext.TLSRole and can be used by a RequestHandlerCtx to reject
+// clients whose role isn't authorized.
+func TestTLSRoleBasedRejection(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert := ca.issue(t, "modbus-server")
+	adminCert := ca.issue(t, "admin")
+	guestCert := ca.issue(t, "guest")
+
+	handler := &roleCheckingHandler{memoryHandler: newMemoryHandler(), allowedRole: "admin"}
+
+	addr, stop := startTLSServer(t, handler, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    ca.pool(),
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	defer stop()
+
+	readHoldingReg0 := func(cert tls.Certificate) (exception bool) {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{
+			RootCAs:      ca.pool(),
+			Certificates: []tls.Certificate{cert},
+		})
+		if err != nil {
+			t.Fatalf("tls.Dial() failed: %v", err)
+		}
+		defer conn.Close()
+
+		// FC 0x03, read 1 holding register at address 0
+		req := []byte{0, 1, 0, 0, 0, 6, 1, 3, 0, 0, 0, 1}
+		if _, err := conn.Write(req); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+
+		resp := make([]byte, 16)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := conn.Read(resp)
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+
+		return n > mbapHeaderLen && resp[mbapHeaderLen]&0x80 != 0
+	}
+
+	if exception := readHoldingReg0(adminCert); exception {
+		t.Errorf("admin cert was rejected, expected it to be allowed")
+	}
+
+	if exception := readHoldingReg0(guestCert); !exception {
+		t.Errorf("guest cert was allowed, expected it to be rejected")
+	}
+}
+
+// roleCheckingHandler rejects every request whose HandlerContext.TLSRole does
+// not match allowedRole, exercising the RequestHandlerCtx extension point.
+type roleCheckingHandler struct {
+	*memoryHandler
+	allowedRole string
+}
+
+func (rh *roleCheckingHandler) HandleHoldingRegistersCtx(hc *HandlerContext, unitId uint8,
+	addr uint16, quantity uint16, isWrite bool, args []uint16) (res []uint16, err error) {
+	if hc.TLSRole != rh.allowedRole {
+		err = ErrIllegalDataAddress
+		return
+	}
+
+	return rh.memoryHandler.HandleHoldingRegisters(unitId, addr, quantity, isWrite, args)
+}
+
+func (rh *roleCheckingHandler) HandleCoilsCtx(hc *HandlerContext, unitId uint8, addr uint16,
+	quantity uint16, isWrite bool, args []bool) (res []bool, err error) {
+	return rh.memoryHandler.HandleCoils(unitId, addr, quantity, isWrite, args)
+}
+
+func (rh *roleCheckingHandler) HandleDiscreteInputsCtx(hc *HandlerContext, unitId uint8,
+	addr uint16, quantity uint16) (res []bool, err error) {
+	return rh.memoryHandler.HandleDiscreteInputs(unitId, addr, quantity)
+}
+
+func (rh *roleCheckingHandler) HandleInputRegistersCtx(hc *HandlerContext, unitId uint8,
+	addr uint16, quantity uint16) (res []uint16, err error) {
+	return rh.memoryHandler.HandleInputRegisters(unitId, addr, quantity)
+}